@@ -3,14 +3,13 @@ package agent
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/pingxeno/agent/collector/cpu"
-	"github.com/pingxeno/agent/collector/disk"
-	"github.com/pingxeno/agent/collector/memory"
-	"github.com/pingxeno/agent/collector/network"
-	"github.com/pingxeno/agent/collector/process"
+	"github.com/pingxeno/agent/collector"
+	_ "github.com/pingxeno/agent/collector/all"
 	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/exporter/prometheus"
 	"github.com/pingxeno/agent/protocol"
 	"github.com/pingxeno/agent/scheduler"
 	"github.com/pingxeno/agent/sender"
@@ -20,16 +19,35 @@ import (
 
 // Agent represents the monitoring agent
 type Agent struct {
-	config     *config.Config
-	scheduler  *scheduler.Scheduler
-	sender     *sender.RetrySender
-	identity   *Identity
-	logger     *zap.Logger
-	cpuCol     cpu.Collector
-	memCol     memory.Collector
-	diskCol    disk.Collector
-	netCol     network.Collector
-	procCol    process.Collector
+	config    *config.Config
+	scheduler *scheduler.Scheduler
+	client    *sender.Client
+	outputs   []*output
+	prom      *prometheus.Exporter
+	stream    *sender.Stream
+	remote    *remoteConfig
+	commands  *commandRunner
+	rotator   *credentialRotator
+	identity  *Identity
+	logger    *zap.Logger
+	registry  *collector.Registry
+	scrape    *collector.Registry // Collectors of their own for Prometheus scrape mode
+
+	// collectMu serialises collections from the main loop and scrapes
+	collectMu sync.Mutex
+	// sections holds the latest section of each collector on its own
+	// schedule, merged into payloads it is not due for; guarded by collectMu
+	sections map[*collector.Entry]collector.Section
+
+	// Settings that change at runtime with viewers and remote configuration
+	settingsMu sync.Mutex
+	interval   time.Duration
+	collectors map[string]bool // nil runs all
+	viewers    int
+
+	startedAt time.Time
+	stop      context.CancelFunc // Ends Run early, for a restart
+	restart   bool
 }
 
 // NewAgent creates a new agent instance
@@ -39,107 +57,183 @@ func NewAgent(cfg *config.Config, logger *zap.Logger) (*Agent, error) {
 		return nil, fmt.Errorf("failed to get identity: %w", err)
 	}
 
-	httpClient := sender.NewClient(cfg, logger)
-	retrySender := sender.NewRetrySender(
-		httpClient,
-		cfg.Sender.RetryAttempts,
-		cfg.Sender.RetryBackoff,
-		logger,
-	)
+	primary, err := newOutput(primaryOutput, config.OutputConfig{Type: "api", Filter: cfg.Filter}, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	outputs := []*output{primary}
+
+	for _, out := range cfg.Outputs {
+		outCfg := *cfg
+		outCfg.Server = out.Server
+		outCfg.Sender = out.Sender
+		outCfg.Queue = out.Queue
+
+		o, err := newOutput(out.Name, out, &outCfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %w", out.Name, err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	registry, err := collector.NewRegistry(cfg.Collection)
+	if err != nil {
+		return nil, err
+	}
 
+	// Collectors with an interval or cron schedule of their own run on it;
+	// the others follow the collection interval
 	sch := scheduler.NewScheduler(cfg.Collection.Interval, cfg.Collection.Jitter)
+	for _, entry := range registry.Entries() {
+		switch {
+		case entry.Cron != "" && entry.Interval > 0:
+			return nil, fmt.Errorf("collection.collector_settings.%s: set either interval or cron", entry.Name)
+		case entry.Cron != "":
+			schedule, err := scheduler.ParseCron(entry.Cron)
+			if err != nil {
+				return nil, fmt.Errorf("collection.collector_settings.%s: %w", entry.Name, err)
+			}
+			sch.SetSchedule(entry.Name, schedule)
+		case entry.Interval > 0:
+			sch.SetSchedule(entry.Name, scheduler.Every(entry.Interval))
+		}
+	}
 
 	agent := &Agent{
-		config:    cfg,
-		scheduler: sch,
-		sender:    retrySender,
-		identity:  identity,
-		logger:    logger,
-		cpuCol:    cpu.NewCollector(),
-		memCol:    memory.NewCollector(),
-		diskCol:   disk.NewCollector(),
-		netCol:    network.NewCollector(),
-		procCol:   process.NewCollector(),
+		config:     cfg,
+		scheduler:  sch,
+		client:     primary.sink.(*sender.Client),
+		outputs:    outputs,
+		identity:   identity,
+		logger:     logger,
+		registry:   registry,
+		interval:   cfg.Collection.Interval,
+		collectors: collectorSet(cfg.Collection.Collectors),
+	}
+
+	if cfg.Remote.Enabled {
+		agent.remote = newRemoteConfig(cfg.Remote, agent.applySettings, logger)
+	}
+
+	if cfg.Commands.Enabled {
+		commands, err := newCommandRunner(agent, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		agent.commands = commands
+	}
+
+	rotator, err := newCredentialRotator(agent, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	agent.rotator = rotator
+
+	if cfg.Stream.Enabled {
+		stream, err := sender.NewStream(cfg, identity.AgentID, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream: %w", err)
+		}
+		stream.OnViewers(agent.viewersChanged)
+		agent.stream = stream
+	}
+
+	if cfg.Prometheus.Enabled {
+		// Scrapes get their own collectors, as CPU and process usage cover
+		// the time since the same collector last ran; sharing them would
+		// shorten the interval of the next scheduled collection
+		if cfg.Prometheus.Mode == prometheus.ModeScrape {
+			agent.scrape, err = collector.NewRegistry(cfg.Collection)
+			if err != nil {
+				return nil, err
+			}
+		}
+		agent.prom = prometheus.NewExporter(cfg.Prometheus, func(ctx context.Context) (*protocol.MetricsPayload, error) {
+			return agent.collect(ctx, agent.scrape, time.Now(), func(string) bool { return true }), nil
+		}, logger)
 	}
 
 	return agent, nil
 }
 
-// CollectMetrics collects all system metrics
-func (a *Agent) CollectMetrics() (*protocol.MetricsPayload, error) {
+// CollectMetrics runs every enabled collector, regardless of schedules,
+// and merges the sections into one payload. It uses the same collectors
+// as the scheduled collections, so CPU and process usage cover the time
+// since the previous collection of either kind.
+func (a *Agent) CollectMetrics(ctx context.Context) (*protocol.MetricsPayload, error) {
+	return a.collect(ctx, a.registry, time.Now(), func(string) bool { return true }), nil
+}
+
+// collect runs the enabled collectors of registry for which due returns
+// true and merges their sections into a payload recorded at the given time.
+// Collectors on their own schedule that are not due contribute the section
+// of their last successful run.
+func (a *Agent) collect(ctx context.Context, registry *collector.Registry, at time.Time, due func(name string) bool) *protocol.MetricsPayload {
+	a.collectMu.Lock()
+	defer a.collectMu.Unlock()
+
+	// The server key is left out: the API client sets it on its own copy,
+	// so it never reaches the queue or a third-party output
 	payload := &protocol.MetricsPayload{
-		ServerKey:   a.config.Server.ServerKey,
-		Hostname:    a.identity.Hostname,
-		OSType:      a.identity.OSType,
-		OSVersion:   a.identity.OSVersion,
-		IPAddress:   a.identity.IPAddress,
-		MachineID:   a.identity.MachineID,
-		SystemUUID:  a.identity.SystemUUID,
-		DiskUUID:    a.identity.DiskUUID,
-		AgentID:     a.identity.AgentID,
-		RecordedAt:  time.Now(),
-	}
-
-	// Collect CPU metrics
-	cpuMetrics, err := cpu.Collect(a.cpuCol)
-	if err != nil {
-		a.logger.Warn("Failed to collect CPU metrics", zap.Error(err))
-	} else {
-		payload.CPUUsagePercent = &cpuMetrics.UsagePercent
-		payload.CPUCores = &cpuMetrics.Cores
-		payload.CPULoad1Min = &cpuMetrics.Load1Min
-		payload.CPULoad5Min = &cpuMetrics.Load5Min
-		payload.CPULoad15Min = &cpuMetrics.Load15Min
+		Hostname:   a.identity.Hostname,
+		OSType:     a.identity.OSType,
+		OSVersion:  a.identity.OSVersion,
+		IPAddress:  a.identity.IPAddress,
+		MachineID:  a.identity.MachineID,
+		SystemUUID: a.identity.SystemUUID,
+		DiskUUID:   a.identity.DiskUUID,
+		AgentID:    a.identity.AgentID,
+		RecordedAt: at,
 	}
-
-	// Collect Memory metrics
-	memMetrics, err := memory.Collect(a.memCol)
-	if err != nil {
-		a.logger.Warn("Failed to collect memory metrics", zap.Error(err))
-	} else {
-		payload.MemoryTotalBytes = &memMetrics.MemoryTotalBytes
-		payload.MemoryUsedBytes = &memMetrics.MemoryUsedBytes
-		payload.MemoryFreeBytes = &memMetrics.MemoryFreeBytes
-		payload.MemoryUsagePercent = &memMetrics.MemoryUsagePercent
-		payload.SwapTotalBytes = &memMetrics.SwapTotalBytes
-		payload.SwapUsedBytes = &memMetrics.SwapUsedBytes
-		payload.SwapFreeBytes = &memMetrics.SwapFreeBytes
-		payload.SwapUsagePercent = &memMetrics.SwapUsagePercent
-	}
-
-	// Collect Disk metrics
-	diskMetrics, err := disk.Collect(a.diskCol)
-	if err != nil {
-		a.logger.Warn("Failed to collect disk metrics", zap.Error(err))
-	} else {
-		payload.DiskUsage = diskMetrics.Partitions
-		payload.DiskTotalBytes = &diskMetrics.TotalBytes
-		payload.DiskUsedBytes = &diskMetrics.UsedBytes
-		payload.DiskFreeBytes = &diskMetrics.FreeBytes
-		payload.DiskUsagePercent = &diskMetrics.UsagePercent
+	if a.remote != nil {
+		a.remote.stamp(payload)
 	}
 
-	// Collect Network metrics
-	netMetrics, err := network.Collect(a.netCol)
-	if err != nil {
-		a.logger.Warn("Failed to collect network metrics", zap.Error(err))
-	} else {
-		payload.NetworkInterfaces = netMetrics.Interfaces
-		payload.NetworkBytesSent = &netMetrics.BytesSent
-		payload.NetworkBytesReceived = &netMetrics.BytesReceived
-		payload.NetworkPacketsSent = &netMetrics.PacketsSent
-		payload.NetworkPacketsReceived = &netMetrics.PacketsReceived
+	a.settingsMu.Lock()
+	collectors := a.collectors
+	a.settingsMu.Unlock()
+
+	var entries []*collector.Entry
+	for _, entry := range registry.Entries() {
+		if !entry.Enabled || (collectors != nil && !collectors[entry.Name]) {
+			continue
+		}
+		if due(entry.Name) {
+			entries = append(entries, entry)
+		} else if section := a.sections[entry]; section != nil {
+			section.Apply(payload)
+		}
 	}
 
-	// Collect Process metrics
-	procMetrics, err := process.Collect(a.procCol)
-	if err != nil {
-		a.logger.Warn("Failed to collect process metrics", zap.Error(err))
-	} else {
-		payload.ProcessesTotal = &procMetrics.Total
-		payload.ProcessesRunning = &procMetrics.Running
-		payload.ProcessesSleeping = &procMetrics.Sleeping
-		payload.Processes = procMetrics.Processes
+	// Collectors run concurrently, each with its own deadline, so one
+	// hung system call only costs its own section
+	for i, result := range collector.RunAll(ctx, entries) {
+		if entry := entries[i]; entry.Interval > 0 || entry.Cron != "" {
+			if a.sections == nil {
+				a.sections = make(map[*collector.Entry]collector.Section)
+			}
+			if result.Err != nil {
+				delete(a.sections, entry)
+			} else {
+				a.sections[entry] = result.Section
+			}
+		}
+		if result.Err != nil {
+			a.logger.Warn("Failed to collect metrics",
+				zap.String("collector", result.Name),
+				zap.Bool("timed_out", result.TimedOut),
+				zap.Duration("duration", result.Duration),
+				zap.Error(result.Err),
+			)
+			payload.CollectionErrors = append(payload.CollectionErrors, protocol.CollectionError{
+				Collector:  result.Name,
+				Error:      result.Err.Error(),
+				TimedOut:   result.TimedOut,
+				DurationMS: result.Duration.Milliseconds(),
+			})
+			continue
+		}
+		result.Section.Apply(payload)
 	}
 
 	// Get uptime
@@ -149,52 +243,207 @@ func (a *Agent) CollectMetrics() (*protocol.MetricsPayload, error) {
 		payload.UptimeSeconds = &uptimeInt
 	}
 
-	return payload, nil
+	return payload
 }
 
 // Run starts the agent's main loop
 func (a *Agent) Run(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	a.settingsMu.Lock()
+	a.startedAt = time.Now()
+	a.stop = stop
+	a.settingsMu.Unlock()
+
 	a.logger.Info("Agent started",
 		zap.String("hostname", a.identity.Hostname),
 		zap.String("os", a.identity.OSType),
 		zap.String("api_url", a.config.Server.APIURL),
+		zap.Int("outputs", len(a.outputs)),
 	)
 
-	for {
-		select {
-		case <-ctx.Done():
-			a.logger.Info("Agent stopping")
-			return nil
-		default:
-			// Collect metrics
-			payload, err := a.CollectMetrics()
-			if err != nil {
-				a.logger.Error("Failed to collect metrics", zap.Error(err))
-				a.scheduler.Wait()
-				continue
+	// Remote configuration is only taken up by the running agent, never by
+	// one-shot commands
+	if a.remote != nil {
+		a.remote.load()
+		a.client.OnConfig(a.remote.offer)
+		a.outputs[0].report = a.remote.result
+	}
+
+	// Every output sends from its own queue in its own goroutine, so
+	// batches can flush on timeout between collections and a slow
+	// destination never delays collection or the other outputs
+	var wg sync.WaitGroup
+	for _, o := range a.outputs {
+		o.open()
+		defer o.close()
+
+		wg.Add(1)
+		go func(o *output) {
+			defer wg.Done()
+			o.ship(ctx)
+		}(o)
+	}
+	defer wg.Wait()
+
+	if a.prom != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.prom.Serve(ctx); err != nil {
+				a.logger.Error("Prometheus endpoint stopped", zap.Error(err))
 			}
+		}()
+	}
 
-			// Send metrics
-			if err := a.sender.SendWithRetry(payload); err != nil {
-				a.logger.Error("Failed to send metrics", zap.Error(err))
-			} else {
-				a.logger.Debug("Metrics sent successfully")
+	if a.stream != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.stream.Run(ctx)
+		}()
+	}
+
+	if a.commands != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.commands.run(ctx)
+		}()
+	}
+
+	if a.rotator != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.rotator.run(ctx)
+		}()
+	}
+
+	// Collect once straight away rather than at the next aligned slot, so
+	// a start, reload or restart is not followed by a silent interval
+	payload := a.collect(ctx, a.registry, time.Now(), func(string) bool { return true })
+	if ctx.Err() == nil {
+		a.publish(payload, true)
+	}
+
+	// While a viewer is attached collections run at the stream's fast
+	// interval; only those a regular interval apart are queued for outputs.
+	// Ticks for collectors on their own schedule are not queued: their
+	// sections are carried by the next queued payload.
+	var lastQueued time.Time
+
+	for {
+		tick, err := a.scheduler.Wait(ctx)
+		if err != nil {
+			queued := 0
+			for _, o := range a.outputs {
+				queued += o.queue.Len()
+			}
+			a.logger.Info("Agent stopping",
+				zap.Int("queued", queued),
+			)
+			if a.restartRequested() {
+				return ErrRestart
 			}
+			return nil
+		}
+
+		payload = a.collect(ctx, a.registry, tick.At, tick.Due)
+		if ctx.Err() != nil {
+			continue
+		}
 
-			// Wait for next collection
-			a.scheduler.Wait()
+		queue := tick.Default && payload.RecordedAt.Sub(lastQueued) >= a.currentInterval()-a.config.Stream.FastInterval/2
+		if queue {
+			lastQueued = payload.RecordedAt
 		}
+		a.publish(payload, queue)
+	}
+}
+
+// publish hands a payload to the stream and the Prometheus endpoint, and
+// queues it for every output if queue is set
+func (a *Agent) publish(payload *protocol.MetricsPayload, queue bool) {
+	if a.stream != nil {
+		a.stream.Publish(a.outputs[0].applyFilter(payload))
+	}
+	if queue {
+		for _, o := range a.outputs {
+			o.enqueue(payload)
+		}
+	}
+	if a.prom != nil {
+		a.prom.Update(payload)
 	}
 }
 
+// requestRestart stops Run, which then returns ErrRestart
+func (a *Agent) requestRestart() {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+
+	a.restart = true
+	if a.stop != nil {
+		a.stop()
+	}
+}
+
+// restartRequested reports whether a restart was requested
+func (a *Agent) restartRequested() bool {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	return a.restart
+}
+
+// viewersChanged switches between the fast and the regular collection
+// interval as viewers attach to and detach from the stream
+func (a *Agent) viewersChanged(viewers int) {
+	a.settingsMu.Lock()
+	a.viewers = viewers
+	interval := a.interval
+	a.settingsMu.Unlock()
+
+	if viewers > 0 {
+		a.logger.Info("Viewer attached, collecting at fast interval",
+			zap.Int("viewers", viewers),
+			zap.Duration("interval", a.config.Stream.FastInterval),
+		)
+		a.scheduler.SetInterval(a.config.Stream.FastInterval, 0)
+		return
+	}
+
+	a.logger.Info("No viewers attached, collecting at regular interval",
+		zap.Duration("interval", interval),
+	)
+	a.scheduler.SetInterval(interval, a.config.Collection.Jitter)
+}
+
+// currentInterval returns the regular collection interval in effect
+func (a *Agent) currentInterval() time.Duration {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	return a.interval
+}
+
 // TestConnection tests the connection to the API
-func (a *Agent) TestConnection() error {
-	client := sender.NewClient(a.config, a.logger)
-	return client.TestConnection()
+func (a *Agent) TestConnection(ctx context.Context) error {
+	return a.client.TestConnection(ctx)
+}
+
+// ProxyRoute describes how the agent reaches the API
+func (a *Agent) ProxyRoute() string {
+	return a.client.ProxyRoute()
+}
+
+// ActiveEndpoint returns the API endpoint the agent currently sends to
+func (a *Agent) ActiveEndpoint() string {
+	return a.client.ActiveEndpoint()
 }
 
-// Sender returns the agent's sender instance (for testing)
+// Sender returns the sender of the main API output (for testing)
 func (a *Agent) Sender() *sender.RetrySender {
-	return a.sender
+	return a.outputs[0].sender
 }
 
@@ -0,0 +1,527 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingxeno/agent/collector/process"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/internal/logger"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// ErrRestart is returned by Run when the agent must be restarted, after a
+// remote command or a credential rotation; the caller should reload the
+// configuration and run a new agent
+var ErrRestart = errors.New("restart requested")
+
+// Limits on the commands the agent accepts
+const (
+	maxCommandLifetime = time.Hour       // Longest allowed expires_at - issued_at
+	maxClockSkew       = 5 * time.Minute // How far issued_at may be in the future
+	maxTopProcesses    = 100             // Upper bound for top_processes limit
+)
+
+// commandRunner polls the API for signed commands and runs them from the
+// fixed set of built-in actions. Every command, including rejected ones,
+// is written to the audit log and its result posted back. IDs of commands
+// run are kept in commands-seen.json next to the audit log until they
+// expire, so a command cannot be replayed across restarts.
+type commandRunner struct {
+	agent     *Agent
+	config    config.CommandsConfig
+	url       string
+	apiKey    string
+	publicKey ed25519.PublicKey
+	allowed   map[string]bool
+	poster    *sender.Poster
+	audit     *logger.RotatingWriter
+	policy    sender.RetryPolicy
+	logger    *zap.Logger
+
+	seen     map[string]time.Time // Command IDs run, until they expire
+	seenFile string               // Where seen is persisted, next to the audit log
+}
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Time       time.Time       `json:"time"`
+	ID         string          `json:"id,omitempty"`
+	Action     string          `json:"action,omitempty"`
+	Args       json.RawMessage `json:"args,omitempty"`
+	IssuedAt   *time.Time      `json:"issued_at,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// newCommandRunner creates the command runner. The audit log is opened
+// by run, so one-shot commands never create it.
+func newCommandRunner(a *Agent, cfg *config.Config, logger *zap.Logger) (*commandRunner, error) {
+	key, err := base64.StdEncoding.DecodeString(cfg.Commands.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("commands.public_key must be a base64 Ed25519 public key")
+	}
+
+	commandsURL := cfg.Commands.URL
+	if commandsURL == "" {
+		commandsURL = strings.TrimSuffix(cfg.Server.APIURL, "/") + "/commands"
+	}
+
+	poster, err := sender.NewPoster(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	allowed := make(map[string]bool)
+	actions := cfg.Commands.Actions
+	if len(actions) == 0 {
+		actions = []string{
+			protocol.ActionCollectNow,
+			protocol.ActionSendDiagnostics,
+			protocol.ActionRestart,
+			protocol.ActionTopProcesses,
+		}
+	}
+	for _, action := range actions {
+		allowed[action] = true
+	}
+
+	return &commandRunner{
+		agent:     a,
+		config:    cfg.Commands,
+		url:       commandsURL,
+		apiKey:    cfg.Server.APIKey,
+		publicKey: ed25519.PublicKey(key),
+		allowed:   allowed,
+		poster:    poster,
+		policy: sender.RetryPolicy{
+			Backoff:    cfg.Sender.RetryBackoff,
+			MaxBackoff: cfg.Sender.RetryMaxBackoff,
+		},
+		logger:   logger.With(zap.String("component", "commands")),
+		seen:     make(map[string]time.Time),
+		seenFile: filepath.Join(filepath.Dir(cfg.Commands.AuditFile), "commands-seen.json"),
+	}, nil
+}
+
+// run polls for commands until ctx is cancelled
+func (c *commandRunner) run(ctx context.Context) {
+	audit, err := logger.NewRotatingWriterWithOptions(c.config.AuditFile, logger.RotateOptions{MaxFiles: 5})
+	if err != nil {
+		c.logger.Error("Failed to open command audit log, commands disabled",
+			zap.String("audit_file", c.config.AuditFile),
+			zap.Error(err),
+		)
+		return
+	}
+	c.audit = audit
+	defer audit.Close()
+	defer c.poster.Close()
+
+	// IDs run before a restart must not be accepted again
+	c.loadSeen()
+
+	c.logger.Info("Polling for remote commands", zap.String("url", c.url))
+
+	failures := 0
+	for ctx.Err() == nil {
+		start := time.Now()
+		commands, err := c.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			wait := c.policy.Delay(failures)
+			if wait < c.config.PollInterval {
+				wait = c.config.PollInterval
+			}
+			c.logger.Warn("Failed to poll for commands",
+				zap.Duration("backoff", wait),
+				zap.Error(err),
+			)
+			if sleepCtx(ctx, wait) != nil {
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		for _, signed := range commands {
+			if ctx.Err() != nil {
+				return
+			}
+			c.handle(ctx, signed)
+		}
+
+		if wait := c.config.PollInterval - time.Since(start); wait > 0 {
+			if sleepCtx(ctx, wait) != nil {
+				return
+			}
+		}
+	}
+}
+
+// poll fetches pending commands, waiting up to poll_wait for one to arrive
+func (c *commandRunner) poll(ctx context.Context) ([]protocol.SignedCommand, error) {
+	request := protocol.CommandPoll{AgentID: c.agent.identity.AgentID}
+	if c.config.PollWait > 0 {
+		request.Wait = c.config.PollWait.String()
+	}
+	body, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := c.poster.Post(ctx, c.url, body, c.header())
+	if err != nil {
+		return nil, err
+	}
+
+	var response protocol.CommandPollResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, fmt.Errorf("invalid poll response: %w", err)
+	}
+	return response.Commands, nil
+}
+
+// handle verifies and runs one command, then audits it and posts the result
+func (c *commandRunner) handle(ctx context.Context, signed protocol.SignedCommand) {
+	result := protocol.CommandResult{StartedAt: time.Now()}
+	var cmd protocol.Command
+
+	err := c.verify(signed, &cmd)
+	result.ID = cmd.ID
+	result.Action = cmd.Action
+	if err != nil {
+		result.Status = protocol.CommandRejected
+		result.Error = err.Error()
+		c.logger.Warn("Rejected remote command",
+			zap.String("id", cmd.ID),
+			zap.String("action", cmd.Action),
+			zap.Error(err),
+		)
+	} else if err := c.claim(cmd); err != nil {
+		result.Status = protocol.CommandRejected
+		result.Error = err.Error()
+		c.logger.Warn("Rejected remote command",
+			zap.String("id", cmd.ID),
+			zap.String("action", cmd.Action),
+			zap.Error(err),
+		)
+	} else {
+		c.logger.Info("Running remote command",
+			zap.String("id", cmd.ID),
+			zap.String("action", cmd.Action),
+		)
+
+		output, err := c.execute(ctx, cmd)
+		result.Output = output
+		if err != nil {
+			result.Status = protocol.CommandFailed
+			result.Error = err.Error()
+		} else {
+			result.Status = protocol.CommandSucceeded
+		}
+	}
+	result.FinishedAt = time.Now()
+
+	c.record(cmd, result)
+	if cmd.ID != "" {
+		if err := c.report(ctx, result); err != nil {
+			c.logger.Warn("Failed to post command result",
+				zap.String("id", cmd.ID),
+				zap.Error(err),
+			)
+		}
+	}
+
+	// Restart only once the result is out
+	if result.Status == protocol.CommandSucceeded && cmd.Action == protocol.ActionRestart {
+		c.logger.Info("Restarting on remote command")
+		c.agent.requestRestart()
+	}
+}
+
+// verify checks the signature, addressee, lifetime and uniqueness of a
+// command and that its action is allowed. cmd is filled in as far as the
+// command could be decoded, so rejections can be reported.
+func (c *commandRunner) verify(signed protocol.SignedCommand, cmd *protocol.Command) error {
+	// Decode first so that rejections carry the ID, but trust nothing
+	// before the signature is checked
+	if err := json.Unmarshal(signed.Command, cmd); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(c.publicKey, signed.Command, signature) {
+		return errors.New("invalid signature")
+	}
+
+	now := time.Now()
+	c.forgetExpired(now)
+
+	switch {
+	case cmd.ID == "":
+		return errors.New("command has no id")
+	case cmd.AgentID != c.agent.identity.AgentID:
+		return errors.New("command is addressed to another agent")
+	case cmd.IssuedAt.After(now.Add(maxClockSkew)):
+		return errors.New("command is issued in the future")
+	case !now.Before(cmd.ExpiresAt):
+		return errors.New("command has expired")
+	case cmd.ExpiresAt.Sub(cmd.IssuedAt) > maxCommandLifetime:
+		return fmt.Errorf("command lifetime exceeds %s", maxCommandLifetime)
+	}
+	if _, ok := c.seen[cmd.ID]; ok {
+		return errors.New("command was already run")
+	}
+	if !c.allowed[cmd.Action] {
+		return fmt.Errorf("action %q is not allowed", cmd.Action)
+	}
+	return nil
+}
+
+// forgetExpired drops command IDs that can no longer be replayed
+func (c *commandRunner) forgetExpired(now time.Time) {
+	for id, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, id)
+		}
+	}
+}
+
+// claim records a verified command's ID as run before it runs. The
+// persisted IDs are read again first, so an ID run by an earlier runner
+// since this one started is caught too. A command whose ID cannot be
+// persisted is not run, as it could be replayed after a restart.
+func (c *commandRunner) claim(cmd protocol.Command) error {
+	c.loadSeen()
+	c.forgetExpired(time.Now())
+	if _, ok := c.seen[cmd.ID]; ok {
+		return errors.New("command was already run")
+	}
+
+	c.seen[cmd.ID] = cmd.ExpiresAt
+	if err := c.saveSeen(); err != nil {
+		delete(c.seen, cmd.ID)
+		return fmt.Errorf("failed to record command id: %w", err)
+	}
+	return nil
+}
+
+// loadSeen merges the persisted command IDs into seen
+func (c *commandRunner) loadSeen() {
+	data, err := os.ReadFile(c.seenFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logger.Warn("Failed to read seen command IDs", zap.Error(err))
+		}
+		return
+	}
+	var seen map[string]time.Time
+	if err := json.Unmarshal(data, &seen); err != nil {
+		c.logger.Warn("Ignoring invalid seen command IDs", zap.Error(err))
+		return
+	}
+	for id, expires := range seen {
+		if expires.After(c.seen[id]) {
+			c.seen[id] = expires
+		}
+	}
+}
+
+// saveSeen atomically persists the IDs that have not expired yet
+func (c *commandRunner) saveSeen() error {
+	data, err := json.MarshalIndent(c.seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.seenFile), 0700); err != nil {
+		return err
+	}
+	tmp := c.seenFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.seenFile)
+}
+
+// execute runs a verified command and returns its output
+func (c *commandRunner) execute(ctx context.Context, cmd protocol.Command) (interface{}, error) {
+	switch cmd.Action {
+	case protocol.ActionCollectNow:
+		return c.agent.collectNow(ctx)
+	case protocol.ActionSendDiagnostics:
+		return c.agent.diagnostics(), nil
+	case protocol.ActionRestart:
+		return map[string]bool{"restarting": true}, nil
+	case protocol.ActionTopProcesses:
+		var args struct {
+			Limit int `json:"limit"`
+		}
+		if len(cmd.Args) > 0 {
+			if err := json.Unmarshal(cmd.Args, &args); err != nil {
+				return nil, fmt.Errorf("invalid args: %w", err)
+			}
+		}
+		if args.Limit <= 0 {
+			args.Limit = 10
+		}
+		if args.Limit > maxTopProcesses {
+			args.Limit = maxTopProcesses
+		}
+		return c.agent.topProcesses(ctx, args.Limit)
+	default:
+		return nil, fmt.Errorf("unknown action %q", cmd.Action)
+	}
+}
+
+// report posts a command result back to the API
+func (c *commandRunner) report(ctx context.Context, result protocol.CommandResult) error {
+	body, err := json.Marshal(&result)
+	if err != nil {
+		return err
+	}
+
+	resultURL := c.url + "/" + url.PathEscape(result.ID) + "/result"
+	_, err = c.poster.Post(ctx, resultURL, body, c.header())
+	return err
+}
+
+// record appends a command to the audit log
+func (c *commandRunner) record(cmd protocol.Command, result protocol.CommandResult) {
+	rec := auditRecord{
+		Time:       result.FinishedAt,
+		ID:         cmd.ID,
+		Action:     cmd.Action,
+		Args:       cmd.Args,
+		Status:     result.Status,
+		Error:      result.Error,
+		DurationMS: result.FinishedAt.Sub(result.StartedAt).Milliseconds(),
+	}
+	if !cmd.IssuedAt.IsZero() {
+		rec.IssuedAt = &cmd.IssuedAt
+	}
+
+	line, err := json.Marshal(&rec)
+	if err == nil {
+		_, err = c.audit.Write(append(line, '\n'))
+	}
+	if err != nil {
+		c.logger.Error("Failed to write command audit log", zap.Error(err))
+	}
+}
+
+func (c *commandRunner) header() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-API-Key", c.apiKey)
+	return header
+}
+
+// collectNow runs a collection outside the schedule and queues it for
+// every output. Like a scheduled collection it starts a new interval for
+// CPU and process usage, so the next scheduled one covers a shorter time.
+func (a *Agent) collectNow(ctx context.Context) (interface{}, error) {
+	payload, err := a.CollectMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.publish(payload, true)
+
+	return map[string]interface{}{
+		"recorded_at": payload.RecordedAt,
+		"outputs":     len(a.outputs),
+	}, nil
+}
+
+// outputDiagnostics describes the state of one output
+type outputDiagnostics struct {
+	Name        string `json:"name"`
+	Queued      int    `json:"queued"`
+	QueuedBytes int64  `json:"queued_bytes"`
+	Dropped     uint64 `json:"dropped"`
+	RetryIn     string `json:"retry_in,omitempty"`
+}
+
+// diagnostics describes the state of the running agent
+func (a *Agent) diagnostics() interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	outputs := make([]outputDiagnostics, 0, len(a.outputs))
+	for _, o := range a.outputs {
+		d := outputDiagnostics{Name: o.name}
+		if o.queue != nil {
+			stats := o.queue.Stats()
+			d.Queued = stats.Pending
+			d.QueuedBytes = stats.Bytes
+			d.Dropped = stats.Dropped
+		}
+		if wait := o.sender.RetryIn(); wait > 0 {
+			d.RetryIn = wait.String()
+		}
+		outputs = append(outputs, d)
+	}
+
+	diag := map[string]interface{}{
+		"hostname":    a.identity.Hostname,
+		"agent_id":    a.identity.AgentID,
+		"os":          runtime.GOOS,
+		"arch":        runtime.GOARCH,
+		"go_version":  runtime.Version(),
+		"started_at":  a.startedAt,
+		"interval":    a.currentInterval().String(),
+		"endpoint":    a.ActiveEndpoint(),
+		"proxy_route": a.ProxyRoute(),
+		"goroutines":  runtime.NumGoroutine(),
+		"heap_bytes":  mem.HeapAlloc,
+		"outputs":     outputs,
+	}
+	if a.remote != nil {
+		diag["config_revision"] = a.remote.revision()
+	}
+	return diag
+}
+
+// topProcesses returns the processes using the most memory
+func (a *Agent) topProcesses(ctx context.Context, limit int) (interface{}, error) {
+	processes, err := process.NewCollector().GetProcesses(ctx, config.ProcessConfig{TopMemory: limit})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].MemoryBytes > processes[j].MemoryBytes
+	})
+	return processes, nil
+}
+
+// sleepCtx waits for d, returning early with the context's error if it is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Enroll exchanges a one-time enrollment token for per-agent credentials
+// and stores them in the configured credentials file
+func Enroll(ctx context.Context, cfg *config.Config, token string, logger *zap.Logger) (*config.Credentials, error) {
+	identity, err := GetIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	poster, err := sender.NewPoster(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer poster.Close()
+
+	request := protocol.EnrollRequest{
+		Token:      token,
+		AgentID:    identity.AgentID,
+		MachineID:  identity.MachineID,
+		SystemUUID: identity.SystemUUID,
+		Hostname:   identity.Hostname,
+		OSType:     identity.OSType,
+		OSVersion:  identity.OSVersion,
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	creds, err := requestCredentials(ctx, poster, enrollURL(cfg), &request, header)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment failed: %w", err)
+	}
+	if err := config.SaveCredentials(creds, cfg.Enrollment.CredentialsFile); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// enrollURL returns enrollment.url, or api_url with /enroll appended
+func enrollURL(cfg *config.Config) string {
+	if cfg.Enrollment.URL != "" {
+		return cfg.Enrollment.URL
+	}
+	return strings.TrimSuffix(cfg.Server.APIURL, "/") + "/enroll"
+}
+
+// requestCredentials posts an enrollment or rotation request and decodes
+// the issued credentials
+func requestCredentials(ctx context.Context, poster *sender.Poster, url string, request interface{}, header http.Header) (*config.Credentials, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := poster.Post(ctx, url, body, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var response protocol.CredentialsResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if response.APIKey == "" || response.ServerKey == "" {
+		return nil, errors.New("response has no api_key or server_key")
+	}
+	return &config.Credentials{
+		APIKey:    response.APIKey,
+		ServerKey: response.ServerKey,
+		ExpiresAt: response.ExpiresAt,
+	}, nil
+}
+
+// credentialRotator replaces issued credentials before they expire. The new
+// credentials are saved and the agent restarted, so every client picks
+// them up from the reloaded configuration.
+type credentialRotator struct {
+	agent  *Agent
+	config config.EnrollmentConfig
+	url    string
+	creds  *config.Credentials
+	poster *sender.Poster
+	policy sender.RetryPolicy
+	logger *zap.Logger
+}
+
+// newCredentialRotator returns a rotator for the stored credentials, or nil
+// if there are none or they do not expire
+func newCredentialRotator(a *Agent, cfg *config.Config, logger *zap.Logger) (*credentialRotator, error) {
+	creds, err := config.LoadCredentials(cfg.Enrollment.CredentialsFile)
+	if err != nil || creds == nil || creds.ExpiresAt.IsZero() {
+		return nil, err
+	}
+
+	poster, err := sender.NewPoster(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	return &credentialRotator{
+		agent:  a,
+		config: cfg.Enrollment,
+		url:    enrollURL(cfg) + "/rotate",
+		creds:  creds,
+		poster: poster,
+		policy: sender.RetryPolicy{
+			Backoff:    cfg.Sender.RetryBackoff,
+			MaxBackoff: cfg.Sender.RetryMaxBackoff,
+		},
+		logger: logger.With(zap.String("component", "credentials")),
+	}, nil
+}
+
+// run waits until rotate_before ahead of expiry, then rotates, retrying
+// with backoff until it succeeds or ctx is cancelled
+func (r *credentialRotator) run(ctx context.Context) {
+	defer r.poster.Close()
+
+	rotateAt := r.creds.ExpiresAt.Add(-r.config.RotateBefore)
+	r.logger.Debug("Credential rotation scheduled",
+		zap.Time("expires_at", r.creds.ExpiresAt),
+		zap.Time("rotate_at", rotateAt),
+	)
+	if sleepCtx(ctx, time.Until(rotateAt)) != nil {
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := r.rotate(ctx)
+		if err == nil {
+			r.logger.Info("Credentials rotated, restarting agent")
+			r.agent.requestRestart()
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := r.policy.Delay(attempt)
+		r.logger.Warn("Failed to rotate credentials",
+			zap.Time("expires_at", r.creds.ExpiresAt),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+		if sleepCtx(ctx, wait) != nil {
+			return
+		}
+	}
+}
+
+// rotate requests and saves new credentials
+func (r *credentialRotator) rotate(ctx context.Context) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-API-Key", r.creds.APIKey)
+
+	request := protocol.RotateRequest{AgentID: r.agent.identity.AgentID}
+	creds, err := requestCredentials(ctx, r.poster, r.url, &request, header)
+	if err != nil {
+		return err
+	}
+	return config.SaveCredentials(creds, r.config.CredentialsFile)
+}
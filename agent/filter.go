@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+)
+
+// filter removes payload sections an output should not receive
+type filter struct {
+	drop map[string]bool
+}
+
+// newFilter returns nil if the configuration keeps every section
+func newFilter(cfg config.FilterConfig) *filter {
+	drop := make(map[string]bool)
+	if len(cfg.Include) > 0 {
+		for _, section := range payloadSections {
+			drop[section] = true
+		}
+		for _, section := range cfg.Include {
+			delete(drop, section)
+		}
+	}
+	for _, section := range cfg.Exclude {
+		drop[section] = true
+	}
+
+	if len(drop) == 0 {
+		return nil
+	}
+	return &filter{drop: drop}
+}
+
+// payloadSections lists the sections a filter can select
+var payloadSections = []string{"cpu", "memory", "swap", "disk", "network", "processes", "uptime"}
+
+// apply returns a copy of payload without the dropped sections. A nil
+// filter returns payload unchanged.
+func (f *filter) apply(payload *protocol.MetricsPayload) *protocol.MetricsPayload {
+	if f == nil {
+		return payload
+	}
+
+	p := *payload
+	if f.drop["cpu"] {
+		p.CPUUsagePercent = nil
+		p.CPUCores = nil
+		p.CPULoad1Min = nil
+		p.CPULoad5Min = nil
+		p.CPULoad15Min = nil
+		p.CPUUserPercent = nil
+		p.CPUSystemPercent = nil
+		p.CPUNicePercent = nil
+		p.CPUIdlePercent = nil
+		p.CPUIowaitPercent = nil
+		p.CPUIrqPercent = nil
+		p.CPUSoftirqPercent = nil
+		p.CPUStealPercent = nil
+		p.CPUGuestPercent = nil
+		p.CPUPerCore = nil
+	}
+	if f.drop["memory"] {
+		p.MemoryTotalBytes = nil
+		p.MemoryUsedBytes = nil
+		p.MemoryFreeBytes = nil
+		p.MemoryUsagePercent = nil
+	}
+	if f.drop["swap"] {
+		p.SwapTotalBytes = nil
+		p.SwapUsedBytes = nil
+		p.SwapFreeBytes = nil
+		p.SwapUsagePercent = nil
+	}
+	if f.drop["disk"] {
+		p.DiskUsage = nil
+		p.DiskTotalBytes = nil
+		p.DiskUsedBytes = nil
+		p.DiskFreeBytes = nil
+		p.DiskUsagePercent = nil
+	}
+	if f.drop["network"] {
+		p.NetworkInterfaces = nil
+		p.NetworkBytesSent = nil
+		p.NetworkBytesReceived = nil
+		p.NetworkPacketsSent = nil
+		p.NetworkPacketsReceived = nil
+	}
+	if f.drop["processes"] {
+		p.ProcessesTotal = nil
+		p.ProcessesRunning = nil
+		p.ProcessesSleeping = nil
+		p.Processes = nil
+	}
+	if f.drop["uptime"] {
+		p.UptimeSeconds = nil
+	}
+	return &p
+}
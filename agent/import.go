@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pingxeno/agent/exporter/ndjson"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// ImportResult counts the payloads handled by Import
+type ImportResult struct {
+	Sent     int // Accepted by the API
+	Rejected int // Refused by the API and dropped
+	Invalid  int // Lines that could not be decoded
+	Skipped  int // Skipped at the caller's request
+}
+
+// Handled returns how many payloads to skip to resume an interrupted import
+func (r ImportResult) Handled() int {
+	return r.Skipped + r.Sent + r.Rejected
+}
+
+// Import replays payloads written by a file output to the main API, in
+// batches when batching is enabled. It stops at the first payload that could
+// not be delivered; the import can then be resumed by skipping the
+// result's Handled payloads.
+func (a *Agent) Import(ctx context.Context, r io.Reader, skip int) (ImportResult, error) {
+	var result ImportResult
+	o := a.outputs[0]
+
+	size := 1
+	if o.batching() {
+		size = o.config.Sender.BatchSize
+	}
+
+	reader := ndjson.NewReader(r)
+	batch := make([]*protocol.MetricsPayload, 0, size)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+
+		// The import stops at the first undelivered payload, so that it can
+		// be resumed by skipping the handled ones
+		for _, err := range o.sendBatch(ctx, batch) {
+			switch {
+			case err == nil:
+				result.Sent++
+			case sender.IsRejected(err):
+				result.Rejected++
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		payload, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *ndjson.LineError
+		if errors.As(err, &lineErr) {
+			a.logger.Warn("Skipping invalid line", zap.Int("line", lineErr.Line), zap.Error(lineErr.Err))
+			result.Invalid++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read payloads: %w", err)
+		}
+
+		if result.Skipped < skip {
+			result.Skipped++
+			continue
+		}
+
+		batch = append(batch, o.applyFilter(payload))
+		if len(batch) == size {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, flush()
+}
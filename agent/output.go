@@ -0,0 +1,353 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/exporter"
+	"github.com/pingxeno/agent/exporter/graphite"
+	"github.com/pingxeno/agent/exporter/influx"
+	"github.com/pingxeno/agent/exporter/ndjson"
+	"github.com/pingxeno/agent/exporter/otlp"
+	"github.com/pingxeno/agent/exporter/prometheus"
+	"github.com/pingxeno/agent/exporter/statsd"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/queue"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// primaryOutput names the output built from the top-level server settings
+const primaryOutput = "api"
+
+// output delivers payloads to one sink. Every output has its own queue,
+// retry policy, circuit breaker and sending goroutine, so a slow or failing
+// destination never holds up the others.
+type output struct {
+	name   string
+	config *config.Config // Effective server, sender and queue settings
+	sink   sender.Sink
+	sender *sender.RetrySender
+	queue  queue.Queue
+	notify chan struct{}
+	logger *zap.Logger
+
+	// report, if set, is called with the final result of every payload sent
+	report func(payload *protocol.MetricsPayload, err error)
+
+	filterMu sync.Mutex
+	filter   *filter
+}
+
+// newOutput creates an output from the server, sender and queue sections
+// of cfg and the output's own settings
+func newOutput(name string, out config.OutputConfig, cfg *config.Config, logger *zap.Logger) (*output, error) {
+	logger = logger.With(zap.String("output", name))
+
+	var sink sender.Sink
+	switch out.Type {
+	case "api":
+		client, err := sender.NewClient(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		sink = client
+	case "otlp":
+		poster, err := sender.NewExternalPoster(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		sink = otlp.NewSink(out.OTLP, poster, logger)
+	case "influx":
+		poster, err := sender.NewExternalPoster(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		sink = influx.NewSink(out.Influx, poster, logger)
+	case "remote_write":
+		poster, err := sender.NewExternalPoster(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		sink = prometheus.NewRemoteWriteSink(out.RemoteWrite, poster, logger)
+	case "graphite":
+		sink = exporter.NewSocketSink(out.Graphite, graphite.Encoder{Prefix: out.Graphite.Prefix}, cfg.Security.Timeout, logger)
+	case "statsd":
+		sink = exporter.NewSocketSink(out.StatsD, statsd.Encoder{Prefix: out.StatsD.Prefix}, cfg.Security.Timeout, logger)
+	case "file":
+		sink = ndjson.NewSink(out.File, logger)
+	default:
+		return nil, fmt.Errorf("unknown output type %q", out.Type)
+	}
+
+	retrySender := sender.NewRetrySender(
+		sink,
+		sender.RetryPolicy{
+			Attempts:   cfg.Sender.RetryAttempts,
+			Backoff:    cfg.Sender.RetryBackoff,
+			MaxBackoff: cfg.Sender.RetryMaxBackoff,
+		},
+		sender.NewBreaker(cfg.Sender.BreakerThreshold, cfg.Sender.BreakerCooldown, logger),
+		logger,
+	)
+
+	return &output{
+		name:   name,
+		config: cfg,
+		sink:   sink,
+		sender: retrySender,
+		filter: newFilter(out.Filter),
+		notify: make(chan struct{}, 1),
+		logger: logger,
+	}, nil
+}
+
+// open opens the output's queue. It is not done in newOutput so that
+// one-shot commands (status, test) never touch the running agent's queue files.
+func (o *output) open() {
+	opts := queue.Options{
+		MaxBytes:     o.config.Queue.MaxBytes,
+		MaxAge:       o.config.Queue.MaxAge,
+		SegmentBytes: o.config.Queue.SegmentBytes,
+	}
+
+	if o.config.Queue.Enabled {
+		q, err := queue.NewDisk(o.config.Queue.Dir, opts, o.logger)
+		if err == nil {
+			o.queue = q
+			return
+		}
+		o.logger.Warn("Failed to open disk queue, buffering in memory",
+			zap.String("dir", o.config.Queue.Dir),
+			zap.Error(err),
+		)
+	}
+
+	o.queue = queue.NewMemory(opts, o.logger)
+}
+
+// close closes the queue and the sink
+func (o *output) close() {
+	if o.queue != nil {
+		o.queue.Close()
+	}
+	o.sink.Close()
+}
+
+// enqueue queues a payload for sending and wakes the sending goroutine
+func (o *output) enqueue(payload *protocol.MetricsPayload) {
+	// Queue metrics so they survive send failures and restarts
+	if err := o.queue.Push(o.applyFilter(payload)); err != nil {
+		o.logger.Error("Failed to queue metrics", zap.Error(err))
+	}
+
+	// Wake the sender without blocking if it is already busy
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ship sends queued payloads whenever new ones arrive or a batch times out
+func (o *output) ship(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.finalFlush()
+			return
+		case <-o.notify:
+		case <-timer.C:
+		}
+
+		wait := o.flushQueue(ctx, false)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+	}
+}
+
+// finalFlush makes a last attempt to send queued payloads on shutdown,
+// bounded by flush_timeout. Anything left stays queued for the next start.
+func (o *output) finalFlush() {
+	if o.queue.Len() == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.config.Sender.FlushTimeout)
+	defer cancel()
+
+	o.flushQueue(ctx, true)
+}
+
+// flushQueue sends queued payloads oldest-first until the queue is empty or
+// a send fails. In batch mode a partial batch is held back until its oldest
+// payload has waited batch_timeout, unless force is set. It returns how
+// long to wait before flushing again, or zero to wait for the next collection.
+func (o *output) flushQueue(ctx context.Context, force bool) time.Duration {
+	size := 1
+	if o.batching() {
+		size = o.config.Sender.BatchSize
+	}
+
+	sent := 0
+	defer func() {
+		if sent > 1 {
+			o.logger.Info("Sent queued metrics", zap.Int("sent", sent))
+		} else if sent == 1 {
+			o.logger.Debug("Metrics sent successfully")
+		}
+	}()
+
+	for o.queue.Len() > 0 && ctx.Err() == nil {
+		batch, err := o.queue.Peek(size)
+		if err != nil {
+			o.logger.Error("Failed to read queued metrics", zap.Error(err))
+			return o.config.Collection.Interval
+		}
+		if len(batch) == 0 {
+			return 0
+		}
+
+		if len(batch) < size && !force {
+			age := time.Since(batch[0].RecordedAt)
+			if age < o.config.Sender.BatchTimeout {
+				return o.config.Sender.BatchTimeout - age
+			}
+		}
+
+		results := o.sendBatch(ctx, batch)
+
+		// Payloads up to the first undelivered one are done with. If any
+		// after it were accepted, only the undelivered ones are queued again,
+		// so the accepted ones are not sent twice.
+		done := 0
+		for done < len(results) && !undelivered(results[done]) {
+			done++
+		}
+		if done < len(results) {
+			err = results[done]
+			var retry []*protocol.MetricsPayload
+			for i := done; i < len(results); i++ {
+				if undelivered(results[i]) {
+					retry = append(retry, batch[i])
+				}
+			}
+			if len(retry) < len(results)-done {
+				if pushErr := o.requeue(retry); pushErr != nil {
+					o.logger.Error("Failed to requeue undelivered metrics", zap.Error(pushErr))
+					return o.config.Collection.Interval
+				}
+				done = len(results)
+			}
+		}
+		if done > 0 {
+			if ackErr := o.queue.Ack(done); ackErr != nil {
+				o.logger.Error("Failed to acknowledge queued metrics", zap.Error(ackErr))
+				return o.config.Collection.Interval
+			}
+			sent += done
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				// Interrupted by shutdown; the payloads stay queued
+				return 0
+			}
+			stats := o.queue.Stats()
+			o.logger.Error("Failed to send metrics, keeping them queued",
+				zap.Int("queued", stats.Pending),
+				zap.Int64("queued_bytes", stats.Bytes),
+				zap.Uint64("dropped_total", stats.Dropped),
+				zap.Error(err),
+			)
+
+			// Probe again as soon as the circuit breaker allows it
+			wait := o.config.Collection.Interval
+			if d := o.sender.RetryIn(); d > 0 && d < wait {
+				wait = d
+			}
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// sendBatch sends a batch and returns the result for each payload. A
+// payload whose result is nil or a rejection is done with; rejections are
+// logged here.
+func (o *output) sendBatch(ctx context.Context, batch []*protocol.MetricsPayload) []error {
+	var results []error
+	if o.batching() {
+		results = o.sender.SendBatchWithRetry(ctx, batch)
+	} else {
+		results = []error{o.sender.SendWithRetry(ctx, batch[0])}
+	}
+
+	if o.report != nil {
+		for i, err := range results {
+			o.report(batch[i], err)
+		}
+	}
+
+	for i, err := range results {
+		if err != nil && sender.IsRejected(err) {
+			o.logger.Warn("Output rejected metrics, dropping them",
+				zap.Time("recorded_at", batch[i].RecordedAt),
+				zap.Error(err),
+			)
+		}
+	}
+	return results
+}
+
+// undelivered reports whether a send result leaves the payload to retry
+func undelivered(err error) bool {
+	return err != nil && !sender.IsRejected(err)
+}
+
+// requeue pushes payloads to the tail of the queue again. They are pushed
+// before the batch is acknowledged, so a crash in between sends them twice
+// rather than losing them.
+func (o *output) requeue(payloads []*protocol.MetricsPayload) error {
+	for _, payload := range payloads {
+		if err := o.queue.Push(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFilter returns payload without the sections the output drops
+func (o *output) applyFilter(payload *protocol.MetricsPayload) *protocol.MetricsPayload {
+	o.filterMu.Lock()
+	defer o.filterMu.Unlock()
+	return o.filter.apply(payload)
+}
+
+// setFilter replaces the output's filter; payloads already queued keep
+// the sections they were queued with
+func (o *output) setFilter(f *filter) {
+	o.filterMu.Lock()
+	defer o.filterMu.Unlock()
+	o.filter = f
+}
+
+// batching reports whether payloads are sent as batches
+func (o *output) batching() bool {
+	return o.config.Sender.BatchEnabled && o.config.Sender.BatchSize > 1
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+// TestOTLPOutputKeepsQueuedOnFailure checks that payloads an OTLP collector
+// fails stay in the output's queue and are delivered on the next flush
+func TestOTLPOutputKeepsQueuedOnFailure(t *testing.T) {
+	var requests, failing atomic.Int32
+	failing.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if failing.Load() == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Queue.Dir = t.TempDir()
+	cfg.Sender.RetryAttempts = 2
+	cfg.Sender.RetryBackoff = time.Millisecond
+	cfg.Sender.RetryMaxBackoff = time.Millisecond
+
+	out, err := newOutput("collector", config.OutputConfig{
+		Type: "otlp",
+		OTLP: config.OTLPConfig{Endpoint: srv.URL + "/v1/metrics"},
+	}, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.open()
+	defer out.close()
+
+	out.enqueue(&protocol.MetricsPayload{Hostname: "web-1", RecordedAt: time.Now()})
+
+	if wait := out.flushQueue(context.Background(), false); wait <= 0 {
+		t.Errorf("failed flush asked to wait %v, want a retry delay", wait)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("collector got %d requests, want 2 attempts", got)
+	}
+	if got := out.queue.Len(); got != 1 {
+		t.Fatalf("queue holds %d payloads after a failed send, want 1", got)
+	}
+
+	failing.Store(0)
+	out.flushQueue(context.Background(), false)
+	if got := out.queue.Len(); got != 0 {
+		t.Errorf("queue holds %d payloads after a successful send, want 0", got)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("collector got %d requests, want 3", got)
+	}
+}
@@ -0,0 +1,298 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/internal/logger"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Bounds on a remotely configured collection interval
+const (
+	minRemoteInterval = 1 * time.Second
+	maxRemoteInterval = 24 * time.Hour
+)
+
+// remoteState is the part of the remote configuration kept across restarts
+type remoteState struct {
+	Applied  *protocol.RemoteConfig    `json:"applied,omitempty"`
+	Good     *protocol.RemoteConfig    `json:"good,omitempty"`
+	Rejected *protocol.ConfigRejection `json:"rejected,omitempty"`
+}
+
+// remoteConfig validates, applies and persists configuration revisions sent
+// by the API. A new revision is confirmed once a payload collected under it
+// is accepted; if such payloads keep failing instead, the agent rolls back
+// to the last confirmed revision and reports the new one as rejected.
+type remoteConfig struct {
+	config config.RemoteConfig
+	apply  func(rc *protocol.RemoteConfig) // nil restores the local configuration
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	state     remoteState
+	confirmed bool
+	failures  int
+}
+
+// newRemoteConfig creates the remote configuration handler. Nothing is
+// applied until load is called.
+func newRemoteConfig(cfg config.RemoteConfig, apply func(*protocol.RemoteConfig), logger *zap.Logger) *remoteConfig {
+	return &remoteConfig{
+		config:    cfg,
+		apply:     apply,
+		logger:    logger,
+		confirmed: true,
+	}
+}
+
+// load restores the last confirmed revision from the state file. An
+// unconfirmed revision is not reapplied; the API sends it again.
+func (r *remoteConfig) load() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.logger.Warn("Failed to read remote configuration state", zap.Error(err))
+		}
+		return
+	}
+	var state remoteState
+	if err := json.Unmarshal(data, &state); err != nil {
+		r.logger.Warn("Ignoring invalid remote configuration state", zap.Error(err))
+		return
+	}
+
+	r.state = state
+	r.state.Applied = state.Good
+	if state.Good != nil {
+		if err := validateRemoteConfig(state.Good); err != nil {
+			r.logger.Warn("Ignoring invalid persisted remote configuration",
+				zap.Int64("revision", state.Good.Revision),
+				zap.Error(err),
+			)
+			r.state.Applied, r.state.Good = nil, nil
+			return
+		}
+		r.apply(state.Good)
+		r.logger.Info("Restored remote configuration", zap.Int64("revision", state.Good.Revision))
+	}
+}
+
+// offer handles a revision received from the API
+func (r *remoteConfig) offer(rc *protocol.RemoteConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if applied := r.state.Applied; applied != nil && rc.Revision <= applied.Revision {
+		return
+	}
+	if rejected := r.state.Rejected; rejected != nil && rc.Revision == rejected.Revision {
+		return
+	}
+
+	if err := validateRemoteConfig(rc); err != nil {
+		r.logger.Warn("Rejected remote configuration",
+			zap.Int64("revision", rc.Revision),
+			zap.Error(err),
+		)
+		r.state.Rejected = &protocol.ConfigRejection{Revision: rc.Revision, Error: err.Error()}
+		r.save()
+		return
+	}
+
+	r.apply(rc)
+	r.state.Applied = rc
+	r.confirmed = false
+	r.failures = 0
+	r.save()
+
+	r.logger.Info("Applied remote configuration", zap.Int64("revision", rc.Revision))
+}
+
+// result records the outcome of sending a payload to the API
+func (r *remoteConfig) result(payload *protocol.MetricsPayload, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Only payloads collected under the unconfirmed revision count
+	if r.confirmed || r.state.Applied == nil || payload.ConfigRevision != r.state.Applied.Revision {
+		return
+	}
+
+	if err == nil {
+		r.confirmed = true
+		r.state.Good = r.state.Applied
+		r.save()
+		r.logger.Info("Remote configuration confirmed", zap.Int64("revision", r.state.Applied.Revision))
+		return
+	}
+
+	// Network failures say nothing about the configuration
+	var apiErr *sender.APIError
+	var itemErr *sender.ItemError
+	if !errors.As(err, &apiErr) && !errors.As(err, &itemErr) {
+		return
+	}
+
+	r.failures++
+	if r.failures < r.config.RollbackAfter {
+		return
+	}
+
+	bad := r.state.Applied
+	r.state.Rejected = &protocol.ConfigRejection{
+		Revision: bad.Revision,
+		Error:    fmt.Sprintf("rolled back after %d failed sends: %v", r.failures, err),
+	}
+	r.apply(r.state.Good)
+	r.state.Applied = r.state.Good
+	r.confirmed = true
+	r.save()
+
+	fields := []zap.Field{
+		zap.Int64("revision", bad.Revision),
+		zap.Int("failures", r.failures),
+		zap.Error(err),
+	}
+	if r.state.Good != nil {
+		fields = append(fields, zap.Int64("restored_revision", r.state.Good.Revision))
+	}
+	r.logger.Warn("Remote configuration caused send failures, rolled back", fields...)
+}
+
+// stamp records the revision in effect and the last rejection on a payload,
+// which acknowledges them to the API
+func (r *remoteConfig) stamp(payload *protocol.MetricsPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.Applied != nil {
+		payload.ConfigRevision = r.state.Applied.Revision
+	}
+	payload.ConfigRejected = r.state.Rejected
+}
+
+// revision returns the revision in effect, or zero for the local configuration
+func (r *remoteConfig) revision() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.Applied == nil {
+		return 0
+	}
+	return r.state.Applied.Revision
+}
+
+// save atomically persists the state; failures are logged, as the
+// configuration still applies until the agent restarts
+func (r *remoteConfig) save() {
+	data, err := json.MarshalIndent(&r.state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.config.StateFile), 0700)
+	}
+	if err == nil {
+		tmp := r.config.StateFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, r.config.StateFile)
+		}
+	}
+	if err != nil {
+		r.logger.Warn("Failed to persist remote configuration", zap.Error(err))
+	}
+}
+
+// validateRemoteConfig checks a revision before it is applied
+func validateRemoteConfig(rc *protocol.RemoteConfig) error {
+	if rc.Revision <= 0 {
+		return fmt.Errorf("revision must be positive")
+	}
+	if rc.Interval != "" {
+		d, err := time.ParseDuration(rc.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval: %w", err)
+		}
+		if d < minRemoteInterval || d > maxRemoteInterval {
+			return fmt.Errorf("interval must be between %s and %s", minRemoteInterval, maxRemoteInterval)
+		}
+	}
+	if err := collector.Validate("collectors", rc.Collectors); err != nil {
+		return err
+	}
+	if rc.Filter != nil {
+		if err := config.ValidateFilter("filter", remoteFilter(rc.Filter)); err != nil {
+			return err
+		}
+	}
+	if rc.LogLevel != "" && !logger.ValidLevel(rc.LogLevel) {
+		return fmt.Errorf("log_level must be one of debug, info, warn, error")
+	}
+	return nil
+}
+
+// remoteFilter converts a remote filter to the local representation
+func remoteFilter(f *protocol.RemoteFilter) config.FilterConfig {
+	return config.FilterConfig{Include: f.Include, Exclude: f.Exclude}
+}
+
+// applySettings applies a revision on top of the local configuration, or
+// restores the local configuration if rc is nil
+func (a *Agent) applySettings(rc *protocol.RemoteConfig) {
+	interval := a.config.Collection.Interval
+	collectors := a.config.Collection.Collectors
+	filterCfg := a.config.Filter
+	level := a.config.Logging.Level
+	if rc != nil {
+		if rc.Interval != "" {
+			interval, _ = time.ParseDuration(rc.Interval)
+		}
+		if len(rc.Collectors) > 0 {
+			collectors = rc.Collectors
+		}
+		if rc.Filter != nil {
+			filterCfg = remoteFilter(rc.Filter)
+		}
+		if rc.LogLevel != "" {
+			level = rc.LogLevel
+		}
+	}
+
+	a.settingsMu.Lock()
+	a.interval = interval
+	a.collectors = collectorSet(collectors)
+	fast := a.viewers > 0
+	a.settingsMu.Unlock()
+
+	// While viewers are attached the new interval takes effect when they leave
+	if !fast {
+		a.scheduler.SetInterval(interval, a.config.Collection.Jitter)
+	}
+	a.outputs[0].setFilter(newFilter(filterCfg))
+	if err := logger.SetLevel(level); err != nil {
+		logger.SetLevel("info")
+	}
+}
+
+// collectorSet returns the enabled collectors, or nil if all are enabled
+func collectorSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -51,12 +52,6 @@ func runGUI() error {
 	}
 	defer log.Sync()
 
-	// Create agent
-	agentInstance, err := agent.NewAgent(cfg, log)
-	if err != nil {
-		return fmt.Errorf("failed to create agent: %w", err)
-	}
-
 	// Run agent in background
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -78,7 +73,22 @@ func runGUI() error {
 	)
 
 	// Run the agent (this will block until context is cancelled)
-	// All output goes to log file, so it can run in background
-	return agentInstance.Run(ctx)
+	// All output goes to log file, so it can run in background.
+	// A restart requested by the agent creates a new one.
+	for {
+		agentInstance, err := agent.NewAgent(cfg, log)
+		if err != nil {
+			return fmt.Errorf("failed to create agent: %w", err)
+		}
+
+		err = agentInstance.Run(ctx)
+		if !errors.Is(err, agent.ErrRestart) {
+			return err
+		}
+		log.Info("Restarting agent")
+		if newCfg, err := config.LoadConfig(configPath); err == nil {
+			cfg = newCfg
+		}
+	}
 }
 
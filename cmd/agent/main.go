@@ -3,18 +3,21 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/pingxeno/agent/agent"
 	"github.com/pingxeno/agent/config"
 	"github.com/pingxeno/agent/internal/logger"
+	"github.com/pingxeno/agent/updater"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -50,6 +53,8 @@ func main() {
 		createStatusCommand(),
 		createConfigCommand(),
 		createTestCommand(),
+		createImportCommand(),
+		createUpdateCommand(),
 		createVersionCommand(),
 		createGUICommand(),
 	)
@@ -91,25 +96,78 @@ func createRunCommand() *cobra.Command {
 			}
 			defer log.Sync()
 
-			agent, err := agent.NewAgent(cfg, log)
-			if err != nil {
-				return fmt.Errorf("failed to create agent: %w", err)
-			}
+			// Handle signals: SIGHUP reloads the config, anything else stops
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			defer signal.Stop(sigChan)
 
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+			for {
+				agentInstance, err := agent.NewAgent(cfg, log)
+				if err != nil {
+					return fmt.Errorf("failed to create agent: %w", err)
+				}
 
-			// Handle signals
-			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+				ctx, cancel := context.WithCancel(context.Background())
+				var reload, updated atomic.Bool
+				var exe string
+				done := make(chan struct{})
+
+				// The background updater stops the agent once a new
+				// binary is installed, so the process can switch to it
+				if cfg.Update.Enabled {
+					u, err := updater.New(cfg, configPath, version, log)
+					if err != nil {
+						log.Error("Failed to start updater", zap.Error(err))
+					} else {
+						exe = u.Path()
+						go u.Run(ctx, func(newVersion string) {
+							log.Info("Update installed", zap.String("version", newVersion))
+							updated.Store(true)
+							cancel()
+						})
+					}
+				}
 
-			go func() {
-				<-sigChan
-				log.Info("Received shutdown signal")
+				go func() {
+					select {
+					case sig := <-sigChan:
+						if sig == syscall.SIGHUP {
+							log.Info("Received reload signal")
+							reload.Store(true)
+						} else {
+							log.Info("Received shutdown signal")
+						}
+						cancel()
+					case <-done:
+					}
+				}()
+
+				err = agentInstance.Run(ctx)
+				close(done)
 				cancel()
-			}()
 
-			return agent.Run(ctx)
+				if updated.Load() {
+					log.Info("Restarting into updated binary")
+					log.Sync()
+					return restartProcess(exe)
+				}
+
+				// A restart requested by the agent reloads the config too
+				if errors.Is(err, agent.ErrRestart) {
+					log.Info("Restarting agent")
+				} else if err != nil || !reload.Load() {
+					return err
+				}
+
+				newCfg, err := config.LoadConfig(configPath)
+				if err != nil {
+					log.Error("Failed to reload config, keeping current one", zap.Error(err))
+					continue
+				}
+				newCfg.Logging.File = cfg.Logging.File
+				cfg = newCfg
+				log.Info("Configuration reloaded", zap.String("config_file", configPath))
+			}
 		},
 	}
 
@@ -123,46 +181,57 @@ func createInstallCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "install",
 		Short: "Install and configure the agent",
-		Long:  "Interactive installation that prompts for configuration",
+		Long: `Interactive installation that prompts for configuration.
+
+With --enroll-token the agent exchanges a one-time token for its own
+credentials instead of prompting for the API and server keys.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fmt.Println("=== PingXeno Agent Installation ===")
 			fmt.Println()
 
 			reader := bufio.NewReader(os.Stdin)
+			enrollToken, _ := cmd.Flags().GetString("enroll-token")
 
 			// Get API URL
-			fmt.Print("Enter API URL (e.g., https://your-domain.com/api/v1/server-stats): ")
-			apiURL, _ := reader.ReadString('\n')
-			apiURL = strings.TrimSpace(apiURL)
+			apiURL, _ := cmd.Flags().GetString("api-url")
+			if apiURL == "" {
+				fmt.Print("Enter API URL (e.g., https://your-domain.com/api/v1/server-stats): ")
+				apiURL, _ = reader.ReadString('\n')
+				apiURL = strings.TrimSpace(apiURL)
+			}
 			if apiURL == "" {
 				return fmt.Errorf("API URL is required")
 			}
 
-			// Get API Key
-			fmt.Print("Enter API Key: ")
-			apiKey, _ := reader.ReadString('\n')
-			apiKey = strings.TrimSpace(apiKey)
-			if apiKey == "" {
-				return fmt.Errorf("API Key is required")
-			}
+			// Enrolled agents receive their own keys
+			var apiKey, serverKey string
+			interval := 60 * time.Second
+			if enrollToken == "" {
+				// Get API Key
+				fmt.Print("Enter API Key: ")
+				apiKey, _ = reader.ReadString('\n')
+				apiKey = strings.TrimSpace(apiKey)
+				if apiKey == "" {
+					return fmt.Errorf("API Key is required")
+				}
 
-			// Get Server Key
-			fmt.Print("Enter Server Key: ")
-			serverKey, _ := reader.ReadString('\n')
-			serverKey = strings.TrimSpace(serverKey)
-			if serverKey == "" {
-				return fmt.Errorf("Server Key is required")
-			}
+				// Get Server Key
+				fmt.Print("Enter Server Key: ")
+				serverKey, _ = reader.ReadString('\n')
+				serverKey = strings.TrimSpace(serverKey)
+				if serverKey == "" {
+					return fmt.Errorf("Server Key is required")
+				}
 
-			// Get Collection Interval
-			fmt.Print("Enter collection interval in seconds (default: 60): ")
-			intervalStr, _ := reader.ReadString('\n')
-			intervalStr = strings.TrimSpace(intervalStr)
-			interval := 60 * time.Second
-			if intervalStr != "" {
-				var seconds int
-				if _, err := fmt.Sscanf(intervalStr, "%d", &seconds); err == nil && seconds > 0 {
-					interval = time.Duration(seconds) * time.Second
+				// Get Collection Interval
+				fmt.Print("Enter collection interval in seconds (default: 60): ")
+				intervalStr, _ := reader.ReadString('\n')
+				intervalStr = strings.TrimSpace(intervalStr)
+				if intervalStr != "" {
+					var seconds int
+					if _, err := fmt.Sscanf(intervalStr, "%d", &seconds); err == nil && seconds > 0 {
+						interval = time.Duration(seconds) * time.Second
+					}
 				}
 			}
 
@@ -179,6 +248,25 @@ func createInstallCommand() *cobra.Command {
 				configPath = getDefaultConfigPath()
 			}
 
+			if enrollToken != "" {
+				var err error
+				log, err = logger.NewLogger("info", "")
+				if err != nil {
+					return fmt.Errorf("failed to create logger: %w", err)
+				}
+				defer log.Sync()
+
+				fmt.Println("Enrolling agent...")
+				creds, err := agent.Enroll(cmd.Context(), cfg, enrollToken, log)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("✓ Credentials saved to: %s\n", cfg.Enrollment.CredentialsFile)
+				if !creds.ExpiresAt.IsZero() {
+					fmt.Printf("  They expire at %s and are rotated automatically\n", creds.ExpiresAt.Local().Format(time.RFC1123))
+				}
+			}
+
 			// Save config
 			if err := config.SaveConfig(cfg, configPath); err != nil {
 				return fmt.Errorf("failed to save config: %w", err)
@@ -193,6 +281,8 @@ func createInstallCommand() *cobra.Command {
 	}
 
 	cmd.Flags().StringP("config", "c", "", "Path to save configuration file")
+	cmd.Flags().String("enroll-token", "", "One-time enrollment token; the agent receives its own credentials")
+	cmd.Flags().String("api-url", "", "API URL (prompted for if not set)")
 
 	return cmd
 }
@@ -303,7 +393,10 @@ func createStatusCommand() *cobra.Command {
 			}
 
 			fmt.Println("Testing API connection...")
-			if err := agent.TestConnection(); err != nil {
+			err = agent.TestConnection(cmd.Context())
+			fmt.Printf("  Endpoint:    %s\n", agent.ActiveEndpoint())
+			fmt.Printf("  Proxy route: %s\n", agent.ProxyRoute())
+			if err != nil {
 				fmt.Printf("✗ Connection failed: %v\n", err)
 				return err
 			}
@@ -312,7 +405,7 @@ func createStatusCommand() *cobra.Command {
 
 			// Collect sample metrics
 			fmt.Println("Collecting system metrics...")
-			payload, err := agent.CollectMetrics()
+			payload, err := agent.CollectMetrics(cmd.Context())
 			if err != nil {
 				fmt.Printf("✗ Failed to collect metrics: %v\n", err)
 				return err
@@ -320,7 +413,7 @@ func createStatusCommand() *cobra.Command {
 
 			// Try to send metrics
 			fmt.Println("Sending test metrics...")
-			if err := agent.Sender().SendWithRetry(payload); err != nil {
+			if err := agent.Sender().SendWithRetry(cmd.Context(), payload); err != nil {
 				fmt.Printf("⚠ Warning: Failed to send test metrics: %v\n", err)
 			} else {
 				fmt.Println("✓ Test metrics sent successfully")
@@ -383,13 +476,13 @@ func createTestCommand() *cobra.Command {
 			}
 
 			fmt.Println("Collecting metrics...")
-			payload, err := agent.CollectMetrics()
+			payload, err := agent.CollectMetrics(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("failed to collect metrics: %w", err)
 			}
 
 			fmt.Println("Sending metrics to API...")
-			if err := agent.Sender().SendWithRetry(payload); err != nil {
+			if err := agent.Sender().SendWithRetry(cmd.Context(), payload); err != nil {
 				return fmt.Errorf("failed to send metrics: %w", err)
 			}
 
@@ -403,6 +496,129 @@ func createTestCommand() *cobra.Command {
 	return cmd
 }
 
+func createUpdateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "update",
+		Short: "Update the agent binary",
+		Long: "Install the latest signed release from update.manifest_url. The new binary is\n" +
+			"health-checked and the previous one restored if it fails to start or send.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, _ := cmd.Flags().GetString("config")
+			if configPath == "" {
+				configPath = findConfigFile()
+			}
+			checkOnly, _ := cmd.Flags().GetBool("check")
+
+			var err error
+			cfg, err = config.LoadConfig(configPath)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			log, err = logger.NewLogger("info", "")
+			if err != nil {
+				return fmt.Errorf("failed to create logger: %w", err)
+			}
+			defer log.Sync()
+
+			u, err := updater.New(cfg, configPath, version, log)
+			if err != nil {
+				return err
+			}
+			defer u.Close()
+
+			fmt.Println("Checking for updates...")
+			release, err := u.Check(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if release == nil {
+				fmt.Printf("✓ PingXeno Agent v%s is up to date\n", version)
+				return nil
+			}
+			fmt.Printf("Update available: v%s -> v%s\n", version, release.Version)
+			if checkOnly {
+				return nil
+			}
+
+			fmt.Println("Installing update...")
+			if err := u.Apply(cmd.Context(), release); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Updated to v%s; restart the agent service to run it\n", release.Version)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("config", "c", "", "Path to configuration file")
+	cmd.Flags().Bool("check", false, "Only report whether an update is available")
+
+	return cmd
+}
+
+func createImportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Replay metrics from a file to the API",
+		Long: "Send metrics written by a file output to the API. Use - to read standard input;\n" +
+			"replay rotated files oldest first, e.g. cat metrics.ndjson.* metrics.ndjson | pingxeno-agent import -",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, _ := cmd.Flags().GetString("config")
+			if configPath == "" {
+				configPath = findConfigFile()
+			}
+			skip, _ := cmd.Flags().GetInt("skip")
+
+			var err error
+			cfg, err = config.LoadConfig(configPath)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			log, err = logger.NewLogger("info", "")
+			if err != nil {
+				return fmt.Errorf("failed to create logger: %w", err)
+			}
+			defer log.Sync()
+
+			input := os.Stdin
+			if args[0] != "-" {
+				input, err = os.Open(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to open %s: %w", args[0], err)
+				}
+				defer input.Close()
+			}
+
+			agent, err := agent.NewAgent(cfg, log)
+			if err != nil {
+				return fmt.Errorf("failed to create agent: %w", err)
+			}
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			fmt.Println("Importing metrics...")
+			result, err := agent.Import(ctx, input, skip)
+			fmt.Printf("  Sent:     %d\n", result.Sent)
+			fmt.Printf("  Rejected: %d\n", result.Rejected)
+			fmt.Printf("  Invalid:  %d\n", result.Invalid)
+			if err != nil {
+				return fmt.Errorf("import stopped, resume with --skip %d: %w", result.Handled(), err)
+			}
+
+			fmt.Println("✓ Import complete!")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("config", "c", "", "Path to configuration file")
+	cmd.Flags().Int("skip", 0, "Number of payloads to skip, to resume an interrupted import")
+
+	return cmd
+}
+
 func createUninstallCommand() *cobra.Command {
 	return &cobra.Command{
 		Use:   "uninstall",
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess replaces the process with exe, keeping the PID so service
+// managers see no exit
+func restartProcess(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,11 @@
+// Package all registers the built-in collectors. Import it for its side
+// effects; a new collector package only needs to be added here.
+package all
+
+import (
+	_ "github.com/pingxeno/agent/collector/cpu"
+	_ "github.com/pingxeno/agent/collector/disk"
+	_ "github.com/pingxeno/agent/collector/memory"
+	_ "github.com/pingxeno/agent/collector/network"
+	_ "github.com/pingxeno/agent/collector/process"
+)
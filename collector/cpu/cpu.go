@@ -1,19 +1,62 @@
 package cpu
 
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/shirou/gopsutil/cpu"
+)
+
 // Collector interface for CPU metrics
 type Collector interface {
-	GetUsagePercent() (float64, error)
+	GetUsage(ctx context.Context) (total Usage, perCore []protocol.CPUCoreUsage, err error)
 	GetCores() (int, error)
 	GetLoadAvg() (load1, load5, load15 float64, err error)
 }
 
+// Usage is the share of CPU time spent in each state since the previous
+// collection, in percent. Busy is everything but idle.
+type Usage struct {
+	Busy    float64
+	User    float64
+	System  float64
+	Nice    float64
+	Idle    float64
+	Iowait  float64
+	Irq     float64
+	Softirq float64
+	Steal   float64
+	Guest   float64 // Also counted in User and Nice, as the kernel reports it
+}
+
 // Metrics represents CPU metrics
 type Metrics struct {
-	UsagePercent float64
-	Cores        int
-	Load1Min     float64
-	Load5Min     float64
-	Load15Min    float64
+	Usage     Usage
+	PerCore   []protocol.CPUCoreUsage
+	Cores     int
+	Load1Min  float64
+	Load5Min  float64
+	Load15Min float64
+}
+
+func init() {
+	collector.Register("cpu", func(config.CollectionConfig) collector.Collector {
+		c := NewCollector()
+		return collector.Func(func(ctx context.Context) (collector.Section, error) {
+			m, err := Collect(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+	})
 }
 
 // NewCollector creates a platform-specific CPU collector
@@ -22,8 +65,8 @@ func NewCollector() Collector {
 }
 
 // Collect gathers all CPU metrics
-func Collect(c Collector) (*Metrics, error) {
-	usage, err := c.GetUsagePercent()
+func Collect(ctx context.Context, c Collector) (*Metrics, error) {
+	usage, perCore, err := c.GetUsage(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -40,10 +83,170 @@ func Collect(c Collector) (*Metrics, error) {
 	}
 
 	return &Metrics{
-		UsagePercent: usage,
-		Cores:        cores,
-		Load1Min:     load1,
-		Load5Min:     load5,
-		Load15Min:    load15,
+		Usage:     usage,
+		PerCore:   perCore,
+		Cores:     cores,
+		Load1Min:  load1,
+		Load5Min:  load5,
+		Load15Min: load15,
 	}, nil
 }
+
+// Apply copies the CPU metrics into a payload
+func (m *Metrics) Apply(payload *protocol.MetricsPayload) {
+	payload.CPUUsagePercent = &m.Usage.Busy
+	payload.CPUUserPercent = &m.Usage.User
+	payload.CPUSystemPercent = &m.Usage.System
+	payload.CPUNicePercent = &m.Usage.Nice
+	payload.CPUIdlePercent = &m.Usage.Idle
+	payload.CPUIowaitPercent = &m.Usage.Iowait
+	payload.CPUIrqPercent = &m.Usage.Irq
+	payload.CPUSoftirqPercent = &m.Usage.Softirq
+	payload.CPUStealPercent = &m.Usage.Steal
+	payload.CPUGuestPercent = &m.Usage.Guest
+	payload.CPUPerCore = m.PerCore
+	payload.CPUCores = &m.Cores
+	payload.CPULoad1Min = &m.Load1Min
+	payload.CPULoad5Min = &m.Load5Min
+	payload.CPULoad15Min = &m.Load15Min
+}
+
+// baselineWindow is how long the first collection measures over, as there
+// are no previous times to compare with yet
+const baselineWindow = time.Second
+
+// sampler keeps the CPU times of the previous collection, so that usage
+// covers exactly the interval between two collections. Every call starts
+// a new interval, so callers that need intervals of their own must use
+// separate collectors. The platform collectors embed it.
+type sampler struct {
+	total *cpu.TimesStat
+	cores map[string]cpu.TimesStat
+}
+
+// GetUsage returns overall and per-core usage since the previous call. Per
+// core usage is left out where the platform does not report it.
+func (s *sampler) GetUsage(ctx context.Context) (Usage, []protocol.CPUCoreUsage, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.total == nil {
+			if err := s.read(ctx); err != nil {
+				return Usage{}, nil, err
+			}
+			timer := time.NewTimer(baselineWindow)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return Usage{}, nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		prevTotal, prevCores := *s.total, s.cores
+		if err := s.read(ctx); err != nil {
+			return Usage{}, nil, err
+		}
+		total, ok := usageBetween(prevTotal, *s.total)
+		if !ok {
+			// The counters did not advance or went backwards, as after a
+			// reset; measure again from a new baseline
+			s.total = nil
+			continue
+		}
+
+		var perCore []protocol.CPUCoreUsage
+		for name, times := range s.cores {
+			prev, ok := prevCores[name]
+			if !ok {
+				continue
+			}
+			if u, ok := usageBetween(prev, times); ok {
+				perCore = append(perCore, coreUsage(name, u))
+			}
+		}
+		sort.Slice(perCore, func(i, j int) bool { return perCore[i].Core < perCore[j].Core })
+		return total, perCore, nil
+	}
+	return Usage{}, nil, errors.New("CPU times are not advancing")
+}
+
+// read stores the current overall and per-core times
+func (s *sampler) read(ctx context.Context) error {
+	total, err := cpu.TimesWithContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	if len(total) == 0 {
+		return errors.New("no CPU times reported")
+	}
+	s.total = &total[0]
+
+	s.cores = nil
+	if perCPU, err := cpu.TimesWithContext(ctx, true); err == nil {
+		s.cores = make(map[string]cpu.TimesStat, len(perCPU))
+		for _, times := range perCPU {
+			s.cores[times.CPU] = times
+		}
+	}
+	return nil
+}
+
+// usageBetween converts the difference between two readings into
+// percentages. It reports false if no time passed between them or a
+// counter went backwards.
+func usageBetween(prev, cur cpu.TimesStat) (Usage, bool) {
+	// Guest time is already part of user and nice time, so Total leaves it out
+	elapsed := cur.Total() - prev.Total()
+	if elapsed <= 0 {
+		return Usage{}, false
+	}
+
+	deltas := []float64{
+		cur.User - prev.User,
+		cur.System - prev.System,
+		cur.Nice - prev.Nice,
+		cur.Idle - prev.Idle,
+		cur.Iowait - prev.Iowait,
+		cur.Irq - prev.Irq,
+		cur.Softirq - prev.Softirq,
+		cur.Steal - prev.Steal,
+		(cur.Guest + cur.GuestNice) - (prev.Guest + prev.GuestNice),
+	}
+	for i, d := range deltas {
+		if d < 0 {
+			return Usage{}, false
+		}
+		deltas[i] = d / elapsed * 100
+	}
+
+	return Usage{
+		Busy:    100 - deltas[3],
+		User:    deltas[0],
+		System:  deltas[1],
+		Nice:    deltas[2],
+		Idle:    deltas[3],
+		Iowait:  deltas[4],
+		Irq:     deltas[5],
+		Softirq: deltas[6],
+		Steal:   deltas[7],
+		Guest:   deltas[8],
+	}, true
+}
+
+// coreUsage converts a core's usage for the payload. Cores are named cpu0,
+// cpu1... by gopsutil on every platform.
+func coreUsage(name string, u Usage) protocol.CPUCoreUsage {
+	core, _ := strconv.Atoi(strings.TrimPrefix(name, "cpu"))
+	return protocol.CPUCoreUsage{
+		Core:           core,
+		UsagePercent:   u.Busy,
+		UserPercent:    u.User,
+		SystemPercent:  u.System,
+		NicePercent:    u.Nice,
+		IdlePercent:    u.Idle,
+		IowaitPercent:  u.Iowait,
+		IrqPercent:     u.Irq,
+		SoftirqPercent: u.Softirq,
+		StealPercent:   u.Steal,
+		GuestPercent:   u.Guest,
+	}
+}
@@ -6,23 +6,14 @@ import (
 	"github.com/shirou/gopsutil/cpu"
 )
 
-type DefaultCollector struct{}
+type DefaultCollector struct {
+	sampler
+}
 
 func newCollector() Collector {
 	return &DefaultCollector{}
 }
 
-func (c *DefaultCollector) GetUsagePercent() (float64, error) {
-	percentages, err := cpu.Percent(0, false)
-	if err != nil {
-		return 0, err
-	}
-	if len(percentages) > 0 {
-		return percentages[0], nil
-	}
-	return 0, nil
-}
-
 func (c *DefaultCollector) GetCores() (int, error) {
 	count, err := cpu.Counts(true)
 	if err != nil {
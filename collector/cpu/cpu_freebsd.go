@@ -7,23 +7,14 @@ import (
 	"github.com/shirou/gopsutil/load"
 )
 
-type FreeBSDCollector struct{}
+type FreeBSDCollector struct {
+	sampler
+}
 
 func newCollector() Collector {
 	return &FreeBSDCollector{}
 }
 
-func (c *FreeBSDCollector) GetUsagePercent() (float64, error) {
-	percentages, err := cpu.Percent(0, false)
-	if err != nil {
-		return 0, err
-	}
-	if len(percentages) > 0 {
-		return percentages[0], nil
-	}
-	return 0, nil
-}
-
 func (c *FreeBSDCollector) GetCores() (int, error) {
 	count, err := cpu.Counts(true)
 	if err != nil {
@@ -7,23 +7,14 @@ import (
 	"github.com/shirou/gopsutil/load"
 )
 
-type LinuxCollector struct{}
+type LinuxCollector struct {
+	sampler
+}
 
 func newCollector() Collector {
 	return &LinuxCollector{}
 }
 
-func (c *LinuxCollector) GetUsagePercent() (float64, error) {
-	percentages, err := cpu.Percent(0, false)
-	if err != nil {
-		return 0, err
-	}
-	if len(percentages) > 0 {
-		return percentages[0], nil
-	}
-	return 0, nil
-}
-
 func (c *LinuxCollector) GetCores() (int, error) {
 	count, err := cpu.Counts(true)
 	if err != nil {
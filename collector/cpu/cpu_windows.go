@@ -6,23 +6,14 @@ import (
 	"github.com/shirou/gopsutil/cpu"
 )
 
-type WindowsCollector struct{}
+type WindowsCollector struct {
+	sampler
+}
 
 func newCollector() Collector {
 	return &WindowsCollector{}
 }
 
-func (c *WindowsCollector) GetUsagePercent() (float64, error) {
-	percentages, err := cpu.Percent(0, false)
-	if err != nil {
-		return 0, err
-	}
-	if len(percentages) > 0 {
-		return percentages[0], nil
-	}
-	return 0, nil
-}
-
 func (c *WindowsCollector) GetCores() (int, error) {
 	count, err := cpu.Counts(true)
 	if err != nil {
@@ -1,6 +1,10 @@
 package disk
 
 import (
+	"context"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
 	"github.com/pingxeno/agent/protocol"
 )
 
@@ -19,6 +23,19 @@ type Metrics struct {
 	UsagePercent  float64
 }
 
+func init() {
+	collector.Register("disk", func(config.CollectionConfig) collector.Collector {
+		c := NewCollector()
+		return collector.Func(func(ctx context.Context) (collector.Section, error) {
+			m, err := Collect(c)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+	})
+}
+
 // NewCollector creates a platform-specific disk collector
 func NewCollector() Collector {
 	return newCollector()
@@ -165,3 +182,12 @@ func Collect(c Collector) (*Metrics, error) {
 		UsagePercent: usagePercent,
 	}, nil
 }
+
+// Apply copies the disk metrics into a payload
+func (m *Metrics) Apply(payload *protocol.MetricsPayload) {
+	payload.DiskUsage = m.Partitions
+	payload.DiskTotalBytes = &m.TotalBytes
+	payload.DiskUsedBytes = &m.UsedBytes
+	payload.DiskFreeBytes = &m.FreeBytes
+	payload.DiskUsagePercent = &m.UsagePercent
+}
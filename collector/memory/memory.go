@@ -1,5 +1,13 @@
 package memory
 
+import (
+	"context"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+)
+
 // Collector interface for memory metrics
 type Collector interface {
 	GetMemory() (total, used, free uint64, err error)
@@ -18,6 +26,19 @@ type Metrics struct {
 	SwapUsagePercent   float64
 }
 
+func init() {
+	collector.Register("memory", func(config.CollectionConfig) collector.Collector {
+		c := NewCollector()
+		return collector.Func(func(ctx context.Context) (collector.Section, error) {
+			m, err := Collect(c)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+	})
+}
+
 // NewCollector creates a platform-specific memory collector
 func NewCollector() Collector {
 	return newCollector()
@@ -64,3 +85,15 @@ func Collect(c Collector) (*Metrics, error) {
 		SwapUsagePercent:   swapUsagePercent,
 	}, nil
 }
+
+// Apply copies the memory metrics into a payload
+func (m *Metrics) Apply(payload *protocol.MetricsPayload) {
+	payload.MemoryTotalBytes = &m.MemoryTotalBytes
+	payload.MemoryUsedBytes = &m.MemoryUsedBytes
+	payload.MemoryFreeBytes = &m.MemoryFreeBytes
+	payload.MemoryUsagePercent = &m.MemoryUsagePercent
+	payload.SwapTotalBytes = &m.SwapTotalBytes
+	payload.SwapUsedBytes = &m.SwapUsedBytes
+	payload.SwapFreeBytes = &m.SwapFreeBytes
+	payload.SwapUsagePercent = &m.SwapUsagePercent
+}
@@ -1,6 +1,10 @@
 package network
 
 import (
+	"context"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
 	"github.com/pingxeno/agent/protocol"
 )
 
@@ -19,6 +23,19 @@ type Metrics struct {
 	PacketsReceived     int64
 }
 
+func init() {
+	collector.Register("network", func(config.CollectionConfig) collector.Collector {
+		c := NewCollector()
+		return collector.Func(func(ctx context.Context) (collector.Section, error) {
+			m, err := Collect(c)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+	})
+}
+
 // NewCollector creates a platform-specific network collector
 func NewCollector() Collector {
 	return newCollector()
@@ -45,3 +62,12 @@ func Collect(c Collector) (*Metrics, error) {
 		PacketsReceived:  packetsRecv,
 	}, nil
 }
+
+// Apply copies the network metrics into a payload
+func (m *Metrics) Apply(payload *protocol.MetricsPayload) {
+	payload.NetworkInterfaces = m.Interfaces
+	payload.NetworkBytesSent = &m.BytesSent
+	payload.NetworkBytesReceived = &m.BytesReceived
+	payload.NetworkPacketsSent = &m.PacketsSent
+	payload.NetworkPacketsReceived = &m.PacketsReceived
+}
@@ -1,11 +1,23 @@
 package process
 
-import "github.com/pingxeno/agent/protocol"
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingxeno/agent/collector"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/process"
+)
 
 // Collector interface for process metrics
 type Collector interface {
 	GetProcessCount() (total, running, sleeping int, err error)
-	GetAllProcesses() ([]protocol.Process, error)
+	GetProcesses(ctx context.Context, cfg config.ProcessConfig) ([]protocol.Process, error)
 }
 
 // Metrics represents process metrics
@@ -16,30 +28,37 @@ type Metrics struct {
 	Processes []protocol.Process
 }
 
+func init() {
+	collector.Register("processes", func(cfg config.CollectionConfig) collector.Collector {
+		c := NewCollector()
+		return collector.Func(func(ctx context.Context) (collector.Section, error) {
+			m, err := Collect(ctx, c, cfg.Processes)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+	})
+}
+
 // NewCollector creates a platform-specific process collector
 func NewCollector() Collector {
 	return newCollector()
 }
 
-// Collect gathers all process metrics
-func Collect(c Collector) (*Metrics, error) {
+// Collect gathers the process counts and the processes selected by cfg
+func Collect(ctx context.Context, c Collector, cfg config.ProcessConfig) (*Metrics, error) {
 	total, running, sleeping, err := c.GetProcessCount()
 	if err != nil {
 		return nil, err
 	}
 
-	// Get all processes (limit to 1000 to avoid payload size issues)
-	processes, err := c.GetAllProcesses()
+	processes, err := c.GetProcesses(ctx, cfg)
 	if err != nil {
 		// Don't fail if we can't get process details, just log it
 		processes = []protocol.Process{}
 	}
 
-	// Limit to 1000 processes to avoid payload size issues
-	if len(processes) > 1000 {
-		processes = processes[:1000]
-	}
-
 	return &Metrics{
 		Total:     total,
 		Running:   running,
@@ -47,3 +66,208 @@ func Collect(c Collector) (*Metrics, error) {
 		Processes: processes,
 	}, nil
 }
+
+// Apply copies the process metrics into a payload
+func (m *Metrics) Apply(payload *protocol.MetricsPayload) {
+	payload.ProcessesTotal = &m.Total
+	payload.ProcessesRunning = &m.Running
+	payload.ProcessesSleeping = &m.Sleeping
+	payload.Processes = m.Processes
+}
+
+// baselineWindow is how long the first collection measures CPU usage
+// over, as there are no previous times to compare with yet
+const baselineWindow = time.Second
+
+// cpuTime is a process's CPU time at one collection. The creation time
+// tells a reused PID apart from the process that had it before.
+type cpuTime struct {
+	createdAt int64
+	seconds   float64
+}
+
+// tracker keeps each process's CPU time from the previous collection, so
+// that CPU usage covers the interval since then rather than the lifetime
+// of the process. As with CPU usage, callers that need intervals of their
+// own must use separate collectors. The platform collectors embed it.
+type tracker struct {
+	times  map[int32]cpuTime
+	readAt time.Time
+}
+
+// candidate is a process considered for the payload
+type candidate struct {
+	proc       *process.Process
+	createdAt  int64
+	cpuPercent float64
+	rss        uint64
+}
+
+// GetProcesses returns the union of the top_cpu busiest processes, the
+// top_memory largest and those matching an include pattern, busiest first
+func (t *tracker) GetProcesses(ctx context.Context, cfg config.ProcessConfig) ([]protocol.Process, error) {
+	if t.times == nil {
+		if _, err := t.read(ctx); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(baselineWindow)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	candidates, err := t.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected := selectProcesses(ctx, candidates, cfg)
+
+	var totalMemory uint64
+	if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
+		totalMemory = vm.Total
+	}
+
+	processes := make([]protocol.Process, 0, len(selected))
+	for _, c := range selected {
+		processes = append(processes, describe(ctx, c, totalMemory))
+	}
+	return processes, nil
+}
+
+// read samples the CPU time and resident memory of every process and
+// stores the times for the next collection
+func (t *tracker) read(ctx context.Context) ([]candidate, error) {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(t.readAt).Seconds()
+	times := make(map[int32]cpuTime, len(pids))
+	candidates := make([]candidate, 0, len(pids))
+	for _, pid := range pids {
+		p, err := process.NewProcessWithContext(ctx, pid)
+		if err != nil {
+			continue
+		}
+		c := candidate{proc: p}
+		c.createdAt, _ = p.CreateTimeWithContext(ctx)
+
+		if cpuTimes, err := p.TimesWithContext(ctx); err == nil {
+			cur := cpuTime{createdAt: c.createdAt, seconds: cpuTimes.User + cpuTimes.System}
+			times[pid] = cur
+			if prev, ok := t.times[pid]; ok && prev.createdAt == cur.createdAt && elapsed > 0 {
+				if used := cur.seconds - prev.seconds; used > 0 {
+					c.cpuPercent = used / elapsed * 100
+				}
+			}
+		}
+		if memInfo, err := p.MemoryInfoWithContext(ctx); err == nil && memInfo != nil {
+			c.rss = memInfo.RSS
+		}
+		candidates = append(candidates, c)
+	}
+
+	t.times, t.readAt = times, now
+	return candidates, nil
+}
+
+// selectProcesses picks the processes for the payload. Processes that used
+// no CPU in the interval are never picked as busiest.
+func selectProcesses(ctx context.Context, candidates []candidate, cfg config.ProcessConfig) []candidate {
+	chosen := make(map[int32]bool)
+	var selected []candidate
+	add := func(c candidate) {
+		if !chosen[c.proc.Pid] {
+			chosen[c.proc.Pid] = true
+			selected = append(selected, c)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].cpuPercent > candidates[j].cpuPercent })
+	for i := 0; i < cfg.TopCPU && i < len(candidates) && candidates[i].cpuPercent > 0; i++ {
+		add(candidates[i])
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].rss > candidates[j].rss })
+	for i := 0; i < cfg.TopMemory && i < len(candidates); i++ {
+		add(candidates[i])
+	}
+
+	if include := compilePatterns(cfg.Include); include != nil {
+		for _, c := range candidates {
+			if !chosen[c.proc.Pid] && matches(ctx, c.proc, include) {
+				add(c)
+			}
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].cpuPercent != selected[j].cpuPercent {
+			return selected[i].cpuPercent > selected[j].cpuPercent
+		}
+		return selected[i].rss > selected[j].rss
+	})
+	return selected
+}
+
+// compilePatterns turns glob patterns into one expression, or nil if there
+// are none. Unlike path.Match, * also matches slashes, so "*postgres*"
+// matches a full command line.
+func compilePatterns(patterns []string) *regexp.Regexp {
+	if len(patterns) == 0 {
+		return nil
+	}
+	alternatives := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		quoted := regexp.QuoteMeta(pattern)
+		quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+		quoted = strings.ReplaceAll(quoted, `\?`, ".")
+		alternatives[i] = quoted
+	}
+	return regexp.MustCompile(`^(?:` + strings.Join(alternatives, "|") + `)$`)
+}
+
+// matches reports whether a process's name or command line matches
+func matches(ctx context.Context, p *process.Process, include *regexp.Regexp) bool {
+	if name, err := p.NameWithContext(ctx); err == nil && include.MatchString(name) {
+		return true
+	}
+	cmdline, err := p.CmdlineWithContext(ctx)
+	return err == nil && include.MatchString(cmdline)
+}
+
+// describe reads the details of a selected process
+func describe(ctx context.Context, c candidate, totalMemory uint64) protocol.Process {
+	p := c.proc
+	name, _ := p.NameWithContext(ctx)
+	status, _ := p.StatusWithContext(ctx)
+	username, _ := p.UsernameWithContext(ctx)
+	cmdline, _ := p.CmdlineWithContext(ctx)
+
+	statusChar := ""
+	if len(status) > 0 {
+		statusChar = string(status[0])
+	}
+
+	var memPercent float64
+	if totalMemory > 0 {
+		memPercent = float64(c.rss) / float64(totalMemory) * 100
+	}
+
+	return protocol.Process{
+		PID:           int(p.Pid),
+		Name:          name,
+		Status:        statusChar,
+		CPUPercent:    c.cpuPercent,
+		MemoryPercent: memPercent,
+		MemoryBytes:   int64(c.rss),
+		User:          username,
+		Command:       cmdline,
+		CreatedAt:     c.createdAt,
+	}
+}
@@ -3,11 +3,12 @@
 package process
 
 import (
-	"github.com/pingxeno/agent/protocol"
 	"github.com/shirou/gopsutil/process"
 )
 
-type LinuxCollector struct{}
+type LinuxCollector struct {
+	tracker
+}
 
 func newCollector() Collector {
 	return &LinuxCollector{}
@@ -45,54 +46,3 @@ func (c *LinuxCollector) GetProcessCount() (total, running, sleeping int, err er
 	return total, running, sleeping, nil
 }
 
-func (c *LinuxCollector) GetAllProcesses() ([]protocol.Process, error) {
-	pids, err := process.Pids()
-	if err != nil {
-		return nil, err
-	}
-
-	var processes []protocol.Process
-	for _, pid := range pids {
-		p, err := process.NewProcess(pid)
-		if err != nil {
-			continue
-		}
-
-		name, _ := p.Name()
-		status, _ := p.Status()
-		cpuPercent, _ := p.CPUPercent()
-		memPercent32, _ := p.MemoryPercent()
-		memInfo, _ := p.MemoryInfo()
-		username, _ := p.Username()
-		cmdline, _ := p.Cmdline()
-		createTime, _ := p.CreateTime()
-
-		statusChar := ""
-		if len(status) > 0 {
-			statusChar = string(status[0])
-		}
-
-		var memBytes int64
-		if memInfo != nil {
-			memBytes = int64(memInfo.RSS)
-		}
-
-		// Convert float32 to float64
-		memPercent := float64(memPercent32)
-
-		processes = append(processes, protocol.Process{
-			PID:          int(pid),
-			Name:         name,
-			Status:       statusChar,
-			CPUPercent:   cpuPercent,
-			MemoryPercent: memPercent,
-			MemoryBytes:  memBytes,
-			User:         username,
-			Command:      cmdline,
-			CreatedAt:    createTime,
-		})
-	}
-
-	return processes, nil
-}
-
@@ -0,0 +1,215 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Section is the typed result of one collector, copied into the payload
+// by Apply
+type Section interface {
+	Apply(payload *protocol.MetricsPayload)
+}
+
+// Collector gathers one section of the payload
+type Collector interface {
+	Collect(ctx context.Context) (Section, error)
+}
+
+// Func adapts a function to the Collector interface
+type Func func(ctx context.Context) (Section, error)
+
+// Collect calls f
+func (f Func) Collect(ctx context.Context) (Section, error) {
+	return f(ctx)
+}
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]func(cfg config.CollectionConfig) Collector)
+)
+
+// Register makes a collector available under name. Collector packages call
+// it from init; it panics if the name is taken. The factory is passed the
+// collection settings for any options of its own.
+func Register(name string, factory func(cfg config.CollectionConfig) Collector) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic("collector: " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names returns the registered collectors in name order
+func Names() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that only registered collectors are named
+func Validate(key string, names []string) error {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	for _, name := range names {
+		if _, ok := factories[name]; !ok {
+			known := make([]string, 0, len(factories))
+			for n := range factories {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("%s: unknown collector %q (use %s)", key, name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// ErrBusy is reported for a collector whose previous run has not returned
+var ErrBusy = errors.New("previous run has not finished")
+
+// Entry is a registered collector with its settings
+type Entry struct {
+	Name      string
+	Enabled   bool
+	Interval  time.Duration // Own schedule; zero follows collection.interval
+	Cron      string        // Own cron schedule, instead of Interval
+	Timeout   time.Duration // Zero waits for it indefinitely
+	Collector Collector
+
+	started atomic.Int64 // Start of the run in progress in Unix nanoseconds, zero when idle
+}
+
+// Result is the outcome of running one collector
+type Result struct {
+	Name     string
+	Section  Section // Nil if Err is set
+	Err      error
+	TimedOut bool
+	Duration time.Duration
+}
+
+// Run runs the collector with its timeout. A collector that does not
+// return in time is abandoned rather than interrupted, since most system
+// calls cannot be cancelled; until it returns, further runs report ErrBusy
+// instead of piling up blocked goroutines, with the time since the
+// abandoned run started as their duration.
+func (e *Entry) Run(ctx context.Context) Result {
+	start := time.Now()
+	if !e.started.CompareAndSwap(0, start.UnixNano()) {
+		result := Result{Name: e.Name, Err: ErrBusy, TimedOut: true}
+		if started := e.started.Load(); started != 0 {
+			result.Duration = start.Sub(time.Unix(0, started))
+		}
+		return result
+	}
+
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan Result, 1)
+	go func() {
+		defer e.started.Store(0)
+		section, err := e.Collector.Collect(ctx)
+		done <- Result{Name: e.Name, Section: section, Err: err}
+	}()
+
+	var result Result
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = Result{Name: e.Name, Err: ctx.Err()}
+	}
+	result.Duration = time.Since(start)
+	result.TimedOut = errors.Is(result.Err, context.DeadlineExceeded)
+	return result
+}
+
+// RunAll runs the collectors concurrently and returns their results in the
+// same order
+func RunAll(ctx context.Context, entries []*Entry) []Result {
+	results := make([]Result, len(entries))
+
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry *Entry) {
+			defer wg.Done()
+			results[i] = entry.Run(ctx)
+		}(i, entry)
+	}
+	wg.Wait()
+	return results
+}
+
+// Registry holds one instance of every registered collector, configured
+// by collection.collector_settings
+type Registry struct {
+	entries []*Entry
+}
+
+// NewRegistry creates every registered collector. Collectors are enabled
+// unless their settings disable them.
+func NewRegistry(cfg config.CollectionConfig) (*Registry, error) {
+	settingNames := make([]string, 0, len(cfg.Settings))
+	for name := range cfg.Settings {
+		settingNames = append(settingNames, name)
+	}
+	if err := Validate("collection.collector_settings", settingNames); err != nil {
+		return nil, err
+	}
+	if err := Validate("collection.collectors", cfg.Collectors); err != nil {
+		return nil, err
+	}
+
+	r := &Registry{}
+	for _, name := range Names() {
+		factoriesMu.Lock()
+		factory := factories[name]
+		factoriesMu.Unlock()
+
+		entry := &Entry{
+			Name:      name,
+			Enabled:   true,
+			Timeout:   cfg.Timeout,
+			Collector: factory(cfg),
+		}
+		if settings, ok := cfg.Settings[name]; ok {
+			if settings.Enabled != nil {
+				entry.Enabled = *settings.Enabled
+			}
+			entry.Interval = settings.Interval
+			entry.Cron = settings.Cron
+			if settings.Timeout > 0 {
+				entry.Timeout = settings.Timeout
+			}
+		}
+		r.entries = append(r.entries, entry)
+	}
+	return r, nil
+}
+
+// Entries returns the collectors in name order
+func (r *Registry) Entries() []*Entry {
+	return r.entries
+}
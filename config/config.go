@@ -7,9 +7,19 @@ import (
 // Config represents the agent configuration
 type Config struct {
 	Server     ServerConfig     `mapstructure:"server"`
+	Enrollment EnrollmentConfig `mapstructure:"enrollment"`
 	Collection CollectionConfig `mapstructure:"collection"`
 	Sender     SenderConfig     `mapstructure:"sender"`
+	Queue      QueueConfig      `mapstructure:"queue"`
 	Security   SecurityConfig   `mapstructure:"security"`
+	Proxy      ProxyConfig      `mapstructure:"proxy"`
+	Filter     FilterConfig     `mapstructure:"filter"`
+	Outputs    []OutputConfig   `mapstructure:"outputs"`
+	Stream     StreamConfig     `mapstructure:"stream"`
+	Remote     RemoteConfig     `mapstructure:"remote_config"`
+	Commands   CommandsConfig   `mapstructure:"commands"`
+	Update     UpdateConfig     `mapstructure:"update"`
+	Prometheus PrometheusConfig `mapstructure:"prometheus"`
 	Logging    LoggingConfig    `mapstructure:"logging"`
 }
 
@@ -18,26 +28,223 @@ type ServerConfig struct {
 	APIURL    string `mapstructure:"api_url"`
 	APIKey    string `mapstructure:"api_key"`
 	ServerKey string `mapstructure:"server_key"`
+
+	// Failover: endpoints are tried in order (SRV targets, then api_url,
+	// then fallback_urls) and a failed one is retried after failback_after
+	FallbackURLs  []string      `mapstructure:"fallback_urls"`
+	SRVRecord     string        `mapstructure:"srv_record"`
+	FailbackAfter time.Duration `mapstructure:"failback_after"`
+}
+
+// EnrollmentConfig contains settings for per-agent credentials. Agents
+// installed with an enrollment token receive their own API and server keys,
+// which are stored in CredentialsFile and rotated before they expire.
+type EnrollmentConfig struct {
+	URL             string        `mapstructure:"url"`              // Defaults to api_url with /enroll appended; rotation uses URL + /rotate
+	CredentialsFile string        `mapstructure:"credentials_file"` // Overrides server.api_key and server.server_key when present
+	RotateBefore    time.Duration `mapstructure:"rotate_before"`    // How long before expiry credentials are rotated
 }
 
 // CollectionConfig contains metric collection settings
 type CollectionConfig struct {
 	Interval time.Duration `mapstructure:"interval"`
 	Jitter   time.Duration `mapstructure:"jitter"`
+	Timeout  time.Duration `mapstructure:"timeout"` // Default deadline for each collector
+
+	// Collectors to run: cpu, memory, disk, network, processes (empty runs all)
+	Collectors []string `mapstructure:"collectors"`
+
+	// Per-collector settings, keyed by collector name
+	Settings map[string]CollectorConfig `mapstructure:"collector_settings"`
+
+	// Processes listed in payloads; the process counts cover all of them
+	Processes ProcessConfig `mapstructure:"processes"`
+}
+
+// ProcessConfig selects the processes listed in payloads: the union of the
+// busiest, the largest and those matching a pattern
+type ProcessConfig struct {
+	TopCPU    int      `mapstructure:"top_cpu"`    // Busiest by CPU since the previous collection
+	TopMemory int      `mapstructure:"top_memory"` // Largest by resident memory
+	Include   []string `mapstructure:"include"`    // Patterns with * and ? matched against the name or command line
+}
+
+// CollectorConfig overrides the defaults of one collector
+type CollectorConfig struct {
+	Enabled  *bool         `mapstructure:"enabled"`  // Defaults to true
+	Interval time.Duration `mapstructure:"interval"` // Own wall-clock aligned interval; zero follows collection.interval
+	Cron     string        `mapstructure:"cron"`     // Own five-field cron schedule, instead of interval
+	Timeout  time.Duration `mapstructure:"timeout"`  // Defaults to collection.timeout
 }
 
 // SenderConfig contains sending/batching settings
 type SenderConfig struct {
-	BatchSize     int           `mapstructure:"batch_size"`
-	BatchTimeout  time.Duration `mapstructure:"batch_timeout"`
-	RetryAttempts int           `mapstructure:"retry_attempts"`
-	RetryBackoff  time.Duration `mapstructure:"retry_backoff"`
+	BatchEnabled     bool          `mapstructure:"batch_enabled"`
+	BatchSize        int           `mapstructure:"batch_size"`
+	BatchTimeout     time.Duration `mapstructure:"batch_timeout"`
+	RetryAttempts    int           `mapstructure:"retry_attempts"`
+	RetryBackoff     time.Duration `mapstructure:"retry_backoff"`
+	RetryMaxBackoff  time.Duration `mapstructure:"retry_max_backoff"`
+	BreakerThreshold int           `mapstructure:"breaker_threshold"`
+	BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown"`
+	FlushTimeout     time.Duration `mapstructure:"flush_timeout"`
+
+	Compression         string `mapstructure:"compression"`
+	CompressionMinBytes int    `mapstructure:"compression_min_bytes"`
+}
+
+// QueueConfig contains outbound queue settings
+type QueueConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Dir          string        `mapstructure:"dir"`
+	MaxBytes     int64         `mapstructure:"max_bytes"`
+	MaxAge       time.Duration `mapstructure:"max_age"`
+	SegmentBytes int64         `mapstructure:"segment_bytes"`
 }
 
 // SecurityConfig contains security settings
 type SecurityConfig struct {
-	TLSSkipVerify bool          `mapstructure:"tls_skip_verify"`
-	Timeout       time.Duration `mapstructure:"timeout"`
+	TLSSkipVerify  bool          `mapstructure:"tls_skip_verify"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	CAFile         string        `mapstructure:"ca_file"`
+	ClientCertFile string        `mapstructure:"client_cert_file"`
+	ClientKeyFile  string        `mapstructure:"client_key_file"`
+	ServerName     string        `mapstructure:"server_name"`
+	MinTLSVersion  string        `mapstructure:"min_tls_version"`
+	SigningSecret  string        `mapstructure:"signing_secret"`
+}
+
+// ProxyConfig contains egress proxy settings. URL schemes http, https
+// and socks5 are supported; without a URL the standard proxy environment
+// variables are used.
+type ProxyConfig struct {
+	URL      string   `mapstructure:"url"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	NoProxy  []string `mapstructure:"no_proxy"`
+}
+
+// FilterConfig selects the payload sections sent to an output. Sections
+// are cpu, memory, swap, disk, network, processes and uptime; identity
+// fields and the timestamp are always sent.
+type FilterConfig struct {
+	Include []string `mapstructure:"include"` // Only send these sections (empty sends all)
+	Exclude []string `mapstructure:"exclude"` // Never send these sections
+}
+
+// OutputConfig describes an additional destination that receives the same
+// payloads as the main API: another PingXeno API, an OTLP collector,
+// InfluxDB, Graphite, StatsD, a Prometheus remote_write receiver or a local
+// NDJSON file. Each output has its own queue, retry and filter settings;
+// sender and queue settings default to the top-level sections.
+type OutputConfig struct {
+	Name   string       `mapstructure:"name"`
+	Type   string       `mapstructure:"type"`
+	Server ServerConfig `mapstructure:"server"`
+	Sender SenderConfig `mapstructure:"sender"`
+	Queue  QueueConfig  `mapstructure:"queue"`
+	Filter FilterConfig `mapstructure:"filter"`
+	OTLP   OTLPConfig   `mapstructure:"otlp"`
+
+	Influx   InfluxConfig `mapstructure:"influx"`
+	Graphite SocketConfig `mapstructure:"graphite"`
+	StatsD   SocketConfig `mapstructure:"statsd"`
+
+	RemoteWrite RemoteWriteConfig `mapstructure:"remote_write"`
+	File        FileConfig        `mapstructure:"file"`
+}
+
+// OTLPConfig contains settings for outputs of type otlp
+type OTLPConfig struct {
+	Endpoint string            `mapstructure:"endpoint"` // e.g. http://collector:4318/v1/metrics
+	Headers  map[string]string `mapstructure:"headers"`
+}
+
+// StreamConfig contains settings for the streaming connection, which
+// pushes every collection to the API over a WebSocket in addition to the
+// regular outputs
+type StreamConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	URL          string        `mapstructure:"url"`           // Defaults to api_url with a ws/wss scheme and /stream appended
+	FastInterval time.Duration `mapstructure:"fast_interval"` // Collection interval while a viewer is attached
+	Heartbeat    time.Duration `mapstructure:"heartbeat"`     // Ping interval; the connection is dropped after two missed pongs
+	Buffer       int           `mapstructure:"buffer"`        // Unacknowledged messages kept for resending
+}
+
+// RemoteConfig controls configuration revisions sent by the API. A revision
+// can override the collection interval, the enabled collectors, the filter
+// of the main API output and the log level.
+type RemoteConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	StateFile     string `mapstructure:"state_file"`     // Where applied revisions are persisted
+	RollbackAfter int    `mapstructure:"rollback_after"` // Failed sends after which a new revision is rolled back
+}
+
+// CommandsConfig contains settings for the remote command channel. The
+// agent polls the API for commands, verifies their Ed25519 signature and
+// runs only built-in actions: collect_now, send_diagnostics, restart and
+// top_processes.
+type CommandsConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	URL          string        `mapstructure:"url"`           // Defaults to api_url with /commands appended
+	PublicKey    string        `mapstructure:"public_key"`    // Base64 Ed25519 key commands are signed with
+	Actions      []string      `mapstructure:"actions"`       // Allowed actions (empty allows all)
+	PollWait     time.Duration `mapstructure:"poll_wait"`     // How long the API may hold a poll open
+	PollInterval time.Duration `mapstructure:"poll_interval"` // Minimum time between polls
+	AuditFile    string        `mapstructure:"audit_file"`
+}
+
+// UpdateConfig contains self-update settings. Releases are described by a
+// JSON manifest listing one binary per platform with its SHA-256 and an
+// Ed25519 signature; the update command uses the same settings.
+type UpdateConfig struct {
+	Enabled         bool          `mapstructure:"enabled"` // Check for and apply updates in the background
+	ManifestURL     string        `mapstructure:"manifest_url"`
+	PublicKey       string        `mapstructure:"public_key"`       // Base64 Ed25519 key releases are signed with
+	CheckInterval   time.Duration `mapstructure:"check_interval"`   // Time between background checks
+	DownloadTimeout time.Duration `mapstructure:"download_timeout"` // How long downloading a release may take
+	HealthTimeout   time.Duration `mapstructure:"health_timeout"`   // How long a new binary has to start and send before it is rolled back
+}
+
+// PrometheusConfig contains settings for the local Prometheus endpoint
+type PrometheusConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Listen  string `mapstructure:"listen"`
+	Path    string `mapstructure:"path"`
+	Mode    string `mapstructure:"mode"` // cache or scrape
+}
+
+// InfluxConfig contains settings for outputs of type influx
+type InfluxConfig struct {
+	URL    string `mapstructure:"url"` // Base URL, e.g. http://influxdb:8086
+	Org    string `mapstructure:"org"`
+	Bucket string `mapstructure:"bucket"`
+	Token  string `mapstructure:"token"`
+}
+
+// SocketConfig contains settings for outputs of type graphite and statsd
+type SocketConfig struct {
+	Network string `mapstructure:"network"` // tcp or udp
+	Address string `mapstructure:"address"` // host:port
+	Prefix  string `mapstructure:"prefix"`  // Prepended to every metric name
+}
+
+// RemoteWriteConfig contains settings for outputs of type remote_write
+type RemoteWriteConfig struct {
+	URL         string            `mapstructure:"url"`
+	Username    string            `mapstructure:"username"` // Basic auth
+	Password    string            `mapstructure:"password"`
+	BearerToken string            `mapstructure:"bearer_token"`
+	Labels      map[string]string `mapstructure:"labels"` // Added to every series
+}
+
+// FileConfig contains settings for outputs of type file, which append
+// every payload as one line of JSON
+type FileConfig struct {
+	Path     string        `mapstructure:"path"`      // "-" writes to standard output
+	MaxSize  int64         `mapstructure:"max_size"`  // Rotate once the file reaches this size
+	MaxFiles int           `mapstructure:"max_files"` // Rotated files to keep (0 keeps all)
+	MaxAge   time.Duration `mapstructure:"max_age"`   // Remove rotated files older than this (0 keeps all)
 }
 
 // LoggingConfig contains logging settings
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Credentials are the per-agent keys issued at enrollment. They are kept in
+// their own file, readable only by the agent, and take precedence over
+// server.api_key and server.server_key.
+type Credentials struct {
+	APIKey    string    `json:"api_key"`
+	ServerKey string    `json:"server_key"`
+	ExpiresAt time.Time `json:"expires_at"` // Zero if they do not expire
+}
+
+// LoadCredentials reads a credentials file. It returns nil without an error
+// if the file does not exist.
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading credentials: %w", err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	if creds.APIKey == "" || creds.ServerKey == "" {
+		return nil, fmt.Errorf("invalid credentials file %s: api_key and server_key are required", path)
+	}
+	return &creds, nil
+}
+
+// SaveCredentials atomically writes a credentials file that only the
+// current user can read
+func SaveCredentials(creds *Credentials, path string) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating credentials directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing credentials: %w", err)
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing credentials: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing credentials: %w", err)
+	}
+	return nil
+}
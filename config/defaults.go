@@ -27,20 +27,76 @@ func DefaultConfig() *Config {
 			APIURL:    "http://localhost:8000/api/v1/server-stats",
 			APIKey:    "",
 			ServerKey: "",
+
+			FailbackAfter: 5 * time.Minute,
 		},
 		Collection: CollectionConfig{
 			Interval: 60 * time.Second,
 			Jitter:   5 * time.Second,
+			Timeout:  10 * time.Second,
+			Processes: ProcessConfig{
+				TopCPU:    10,
+				TopMemory: 10,
+			},
 		},
 		Sender: SenderConfig{
-			BatchSize:     10,
-			BatchTimeout:  30 * time.Second,
-			RetryAttempts: 3,
-			RetryBackoff:  2 * time.Second,
+			BatchEnabled:     false,
+			BatchSize:        10,
+			BatchTimeout:     30 * time.Second,
+			RetryAttempts:    3,
+			RetryBackoff:     2 * time.Second,
+			RetryMaxBackoff:  30 * time.Second,
+			BreakerThreshold: 5,
+			BreakerCooldown:  60 * time.Second,
+			FlushTimeout:     10 * time.Second,
+
+			Compression:         "none",
+			CompressionMinBytes: 1024,
+		},
+		Queue: QueueConfig{
+			Enabled:      true,
+			Dir:          filepath.Join(DefaultStateDir(), "queue"),
+			MaxBytes:     64 * 1024 * 1024,
+			MaxAge:       24 * time.Hour,
+			SegmentBytes: 1024 * 1024,
+		},
+		Enrollment: EnrollmentConfig{
+			CredentialsFile: filepath.Join(DefaultStateDir(), "credentials.json"),
+			RotateBefore:    24 * time.Hour,
 		},
 		Security: SecurityConfig{
 			TLSSkipVerify: false,
 			Timeout:       30 * time.Second,
+			MinTLSVersion: "1.2",
+		},
+		Stream: StreamConfig{
+			Enabled:      false,
+			FastInterval: 1 * time.Second,
+			Heartbeat:    15 * time.Second,
+			Buffer:       300,
+		},
+		Remote: RemoteConfig{
+			Enabled:       false,
+			StateFile:     filepath.Join(DefaultStateDir(), "remote-config.json"),
+			RollbackAfter: 3,
+		},
+		Commands: CommandsConfig{
+			Enabled:      false,
+			PollWait:     20 * time.Second,
+			PollInterval: 10 * time.Second,
+			AuditFile:    filepath.Join(DefaultStateDir(), "commands-audit.log"),
+		},
+		Update: UpdateConfig{
+			Enabled:         false,
+			CheckInterval:   6 * time.Hour,
+			DownloadTimeout: 10 * time.Minute,
+			HealthTimeout:   2 * time.Minute,
+		},
+		Prometheus: PrometheusConfig{
+			Enabled: false,
+			Listen:  "127.0.0.1:9273",
+			Path:    "/metrics",
+			Mode:    "cache",
 		},
 		Logging: LoggingConfig{
 			Level: "info",
@@ -49,3 +105,17 @@ func DefaultConfig() *Config {
 	}
 }
 
+// DefaultStateDir returns the directory for persistent agent state
+func DefaultStateDir() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = "C:\\ProgramData"
+		}
+		return filepath.Join(programData, "PingXeno", "state")
+	}
+	if os.Geteuid() == 0 {
+		return "/var/lib/pingxeno-agent"
+	}
+	return filepath.Join(os.Getenv("HOME"), ".pingxeno", "state")
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -33,6 +36,8 @@ func LoadConfig(configPath string) (*Config, error) {
 	viper.BindEnv("server.api_url", "PINGXENO_API_URL")
 	viper.BindEnv("server.api_key", "PINGXENO_API_KEY")
 	viper.BindEnv("server.server_key", "PINGXENO_SERVER_KEY")
+	viper.BindEnv("security.signing_secret", "PINGXENO_SIGNING_SECRET")
+	viper.BindEnv("proxy.password", "PINGXENO_PROXY_PASSWORD")
 
 	// Read config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -46,9 +51,30 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
+	// Credentials issued at enrollment replace the configured keys
+	if cfg.Enrollment.CredentialsFile == "" {
+		cfg.Enrollment.CredentialsFile = filepath.Join(DefaultStateDir(), "credentials.json")
+	}
+	creds, err := LoadCredentials(cfg.Enrollment.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		cfg.Server.APIKey = creds.APIKey
+		cfg.Server.ServerKey = creds.ServerKey
+	}
+	if rotateStr := viper.GetString("enrollment.rotate_before"); rotateStr != "" {
+		if d, err := time.ParseDuration(rotateStr); err == nil {
+			cfg.Enrollment.RotateBefore = d
+		}
+	}
+	if cfg.Enrollment.RotateBefore == 0 {
+		cfg.Enrollment.RotateBefore = 24 * time.Hour
+	}
+
 	// Validate required fields
 	if cfg.Server.APIKey == "" {
-		return nil, fmt.Errorf("server.api_key is required")
+		return nil, fmt.Errorf("server.api_key is required (or enroll with install --enroll-token)")
 	}
 	if cfg.Server.ServerKey == "" {
 		return nil, fmt.Errorf("server.server_key is required")
@@ -58,6 +84,15 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// Parse duration strings from viper if they're strings
+	if failbackStr := viper.GetString("server.failback_after"); failbackStr != "" {
+		if d, err := time.ParseDuration(failbackStr); err == nil {
+			cfg.Server.FailbackAfter = d
+		}
+	}
+	if cfg.Server.FailbackAfter == 0 {
+		cfg.Server.FailbackAfter = 5 * time.Minute
+	}
+
 	if intervalStr := viper.GetString("collection.interval"); intervalStr != "" {
 		if d, err := time.ParseDuration(intervalStr); err == nil {
 			cfg.Collection.Interval = d
@@ -76,6 +111,19 @@ func LoadConfig(configPath string) (*Config, error) {
 		cfg.Collection.Jitter = 5 * time.Second
 	}
 
+	if timeoutStr := viper.GetString("collection.timeout"); timeoutStr != "" {
+		if d, err := time.ParseDuration(timeoutStr); err == nil {
+			cfg.Collection.Timeout = d
+		}
+	}
+	if cfg.Collection.Timeout == 0 {
+		cfg.Collection.Timeout = 10 * time.Second
+	}
+
+	if cfg.Collection.Processes.TopCPU < 0 || cfg.Collection.Processes.TopMemory < 0 {
+		return nil, fmt.Errorf("collection.processes.top_cpu and top_memory must not be negative")
+	}
+
 	if timeoutStr := viper.GetString("sender.batch_timeout"); timeoutStr != "" {
 		if d, err := time.ParseDuration(timeoutStr); err == nil {
 			cfg.Sender.BatchTimeout = d
@@ -85,6 +133,10 @@ func LoadConfig(configPath string) (*Config, error) {
 		cfg.Sender.BatchTimeout = 30 * time.Second
 	}
 
+	if cfg.Sender.BatchSize <= 0 {
+		cfg.Sender.BatchSize = 10
+	}
+
 	if backoffStr := viper.GetString("sender.retry_backoff"); backoffStr != "" {
 		if d, err := time.ParseDuration(backoffStr); err == nil {
 			cfg.Sender.RetryBackoff = d
@@ -94,6 +146,48 @@ func LoadConfig(configPath string) (*Config, error) {
 		cfg.Sender.RetryBackoff = 2 * time.Second
 	}
 
+	if maxBackoffStr := viper.GetString("sender.retry_max_backoff"); maxBackoffStr != "" {
+		if d, err := time.ParseDuration(maxBackoffStr); err == nil {
+			cfg.Sender.RetryMaxBackoff = d
+		}
+	}
+	if cfg.Sender.RetryMaxBackoff == 0 {
+		cfg.Sender.RetryMaxBackoff = 30 * time.Second
+	}
+
+	if cooldownStr := viper.GetString("sender.breaker_cooldown"); cooldownStr != "" {
+		if d, err := time.ParseDuration(cooldownStr); err == nil {
+			cfg.Sender.BreakerCooldown = d
+		}
+	}
+	if cfg.Sender.BreakerCooldown == 0 {
+		cfg.Sender.BreakerCooldown = 60 * time.Second
+	}
+
+	if flushStr := viper.GetString("sender.flush_timeout"); flushStr != "" {
+		if d, err := time.ParseDuration(flushStr); err == nil {
+			cfg.Sender.FlushTimeout = d
+		}
+	}
+	if cfg.Sender.FlushTimeout == 0 {
+		cfg.Sender.FlushTimeout = 10 * time.Second
+	}
+
+	switch cfg.Sender.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("sender.compression must be one of none, gzip, zstd")
+	}
+
+	if maxAgeStr := viper.GetString("queue.max_age"); maxAgeStr != "" {
+		if d, err := time.ParseDuration(maxAgeStr); err == nil {
+			cfg.Queue.MaxAge = d
+		}
+	}
+	if cfg.Queue.Dir == "" {
+		cfg.Queue.Dir = filepath.Join(DefaultStateDir(), "queue")
+	}
+
 	if timeoutStr := viper.GetString("security.timeout"); timeoutStr != "" {
 		if d, err := time.ParseDuration(timeoutStr); err == nil {
 			cfg.Security.Timeout = d
@@ -103,6 +197,151 @@ func LoadConfig(configPath string) (*Config, error) {
 		cfg.Security.Timeout = 30 * time.Second
 	}
 
+	switch cfg.Security.MinTLSVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return nil, fmt.Errorf("security.min_tls_version must be one of 1.0, 1.1, 1.2, 1.3")
+	}
+	if (cfg.Security.ClientCertFile == "") != (cfg.Security.ClientKeyFile == "") {
+		return nil, fmt.Errorf("security.client_cert_file and security.client_key_file must be set together")
+	}
+
+	if cfg.Proxy.URL != "" {
+		u, err := url.Parse(cfg.Proxy.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy.url: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy.url scheme must be one of http, https, socks5")
+		}
+	}
+
+	if fastStr := viper.GetString("stream.fast_interval"); fastStr != "" {
+		if d, err := time.ParseDuration(fastStr); err == nil {
+			cfg.Stream.FastInterval = d
+		}
+	}
+	if cfg.Stream.FastInterval == 0 {
+		cfg.Stream.FastInterval = 1 * time.Second
+	}
+
+	if heartbeatStr := viper.GetString("stream.heartbeat"); heartbeatStr != "" {
+		if d, err := time.ParseDuration(heartbeatStr); err == nil {
+			cfg.Stream.Heartbeat = d
+		}
+	}
+	if cfg.Stream.Heartbeat == 0 {
+		cfg.Stream.Heartbeat = 15 * time.Second
+	}
+
+	if cfg.Stream.Buffer <= 0 {
+		cfg.Stream.Buffer = 300
+	}
+	if cfg.Stream.URL != "" {
+		u, err := url.Parse(cfg.Stream.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream.url: %w", err)
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return nil, fmt.Errorf("stream.url scheme must be ws or wss")
+		}
+	}
+
+	if waitStr := viper.GetString("commands.poll_wait"); waitStr != "" {
+		if d, err := time.ParseDuration(waitStr); err == nil {
+			cfg.Commands.PollWait = d
+		}
+	}
+	if pollStr := viper.GetString("commands.poll_interval"); pollStr != "" {
+		if d, err := time.ParseDuration(pollStr); err == nil {
+			cfg.Commands.PollInterval = d
+		}
+	}
+	if cfg.Commands.PollInterval == 0 {
+		cfg.Commands.PollInterval = 10 * time.Second
+	}
+	if cfg.Commands.AuditFile == "" {
+		cfg.Commands.AuditFile = filepath.Join(DefaultStateDir(), "commands-audit.log")
+	}
+	if cfg.Commands.Enabled {
+		key, err := base64.StdEncoding.DecodeString(cfg.Commands.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("commands.public_key must be a base64 Ed25519 public key")
+		}
+		if cfg.Commands.PollWait >= cfg.Security.Timeout {
+			return nil, fmt.Errorf("commands.poll_wait must be shorter than security.timeout")
+		}
+		for _, action := range cfg.Commands.Actions {
+			if !commandActions[action] {
+				return nil, fmt.Errorf("commands.actions: unknown action %q (use collect_now, send_diagnostics, restart or top_processes)", action)
+			}
+		}
+	}
+
+	if checkStr := viper.GetString("update.check_interval"); checkStr != "" {
+		if d, err := time.ParseDuration(checkStr); err == nil {
+			cfg.Update.CheckInterval = d
+		}
+	}
+	if cfg.Update.CheckInterval == 0 {
+		cfg.Update.CheckInterval = 6 * time.Hour
+	}
+	if downloadStr := viper.GetString("update.download_timeout"); downloadStr != "" {
+		if d, err := time.ParseDuration(downloadStr); err == nil {
+			cfg.Update.DownloadTimeout = d
+		}
+	}
+	if cfg.Update.DownloadTimeout == 0 {
+		cfg.Update.DownloadTimeout = 10 * time.Minute
+	}
+	if healthStr := viper.GetString("update.health_timeout"); healthStr != "" {
+		if d, err := time.ParseDuration(healthStr); err == nil {
+			cfg.Update.HealthTimeout = d
+		}
+	}
+	if cfg.Update.HealthTimeout == 0 {
+		cfg.Update.HealthTimeout = 2 * time.Minute
+	}
+	if cfg.Update.Enabled {
+		if cfg.Update.ManifestURL == "" {
+			return nil, fmt.Errorf("update.manifest_url is required when update is enabled")
+		}
+		key, err := base64.StdEncoding.DecodeString(cfg.Update.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("update.public_key must be a base64 Ed25519 public key")
+		}
+	}
+
+	switch cfg.Prometheus.Mode {
+	case "":
+		cfg.Prometheus.Mode = "cache"
+	case "cache", "scrape":
+	default:
+		return nil, fmt.Errorf("prometheus.mode must be one of cache, scrape")
+	}
+	if cfg.Prometheus.Path == "" {
+		cfg.Prometheus.Path = "/metrics"
+	}
+	if cfg.Prometheus.Enabled && cfg.Prometheus.Listen == "" {
+		return nil, fmt.Errorf("prometheus.listen is required when prometheus is enabled")
+	}
+
+	if err := ValidateFilter("filter", cfg.Filter); err != nil {
+		return nil, err
+	}
+
+	if cfg.Remote.StateFile == "" {
+		cfg.Remote.StateFile = filepath.Join(DefaultStateDir(), "remote-config.json")
+	}
+	if cfg.Remote.RollbackAfter <= 0 {
+		cfg.Remote.RollbackAfter = 3
+	}
+	if err := loadOutputs(cfg); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
@@ -118,20 +357,345 @@ func SaveConfig(cfg *Config, path string) error {
 	v := viper.New()
 	v.SetConfigType("yaml")
 
+	// Issued credentials stay in their own file
+	apiKey, serverKey := cfg.Server.APIKey, cfg.Server.ServerKey
+	if creds, _ := LoadCredentials(cfg.Enrollment.CredentialsFile); creds != nil && creds.APIKey == apiKey {
+		apiKey, serverKey = "", ""
+	}
+
 	v.Set("server.api_url", cfg.Server.APIURL)
-	v.Set("server.api_key", cfg.Server.APIKey)
-	v.Set("server.server_key", cfg.Server.ServerKey)
+	v.Set("server.api_key", apiKey)
+	v.Set("server.server_key", serverKey)
+	v.Set("server.fallback_urls", cfg.Server.FallbackURLs)
+	v.Set("server.srv_record", cfg.Server.SRVRecord)
+	v.Set("server.failback_after", cfg.Server.FailbackAfter.String())
 	v.Set("collection.interval", cfg.Collection.Interval.String())
 	v.Set("collection.jitter", cfg.Collection.Jitter.String())
-	v.Set("sender.batch_size", cfg.Sender.BatchSize)
-	v.Set("sender.batch_timeout", cfg.Sender.BatchTimeout.String())
-	v.Set("sender.retry_attempts", cfg.Sender.RetryAttempts)
-	v.Set("sender.retry_backoff", cfg.Sender.RetryBackoff.String())
+	v.Set("collection.timeout", cfg.Collection.Timeout.String())
+	v.Set("collection.collectors", cfg.Collection.Collectors)
+	v.Set("collection.collector_settings", collectorSettings(cfg.Collection.Settings))
+	v.Set("collection.processes.top_cpu", cfg.Collection.Processes.TopCPU)
+	v.Set("collection.processes.top_memory", cfg.Collection.Processes.TopMemory)
+	v.Set("collection.processes.include", cfg.Collection.Processes.Include)
+	v.Set("sender", senderSettings(cfg.Sender))
+	v.Set("queue", queueSettings(cfg.Queue))
 	v.Set("security.tls_skip_verify", cfg.Security.TLSSkipVerify)
 	v.Set("security.timeout", cfg.Security.Timeout.String())
+	v.Set("security.ca_file", cfg.Security.CAFile)
+	v.Set("security.client_cert_file", cfg.Security.ClientCertFile)
+	v.Set("security.client_key_file", cfg.Security.ClientKeyFile)
+	v.Set("security.server_name", cfg.Security.ServerName)
+	v.Set("security.min_tls_version", cfg.Security.MinTLSVersion)
+	v.Set("security.signing_secret", cfg.Security.SigningSecret)
+	v.Set("proxy.url", cfg.Proxy.URL)
+	v.Set("proxy.username", cfg.Proxy.Username)
+	v.Set("proxy.password", cfg.Proxy.Password)
+	v.Set("proxy.no_proxy", cfg.Proxy.NoProxy)
+	v.Set("filter", filterSettings(cfg.Filter))
+	v.Set("stream.enabled", cfg.Stream.Enabled)
+	v.Set("stream.url", cfg.Stream.URL)
+	v.Set("stream.fast_interval", cfg.Stream.FastInterval.String())
+	v.Set("stream.heartbeat", cfg.Stream.Heartbeat.String())
+	v.Set("stream.buffer", cfg.Stream.Buffer)
+	v.Set("remote_config.enabled", cfg.Remote.Enabled)
+	v.Set("remote_config.state_file", cfg.Remote.StateFile)
+	v.Set("remote_config.rollback_after", cfg.Remote.RollbackAfter)
+	v.Set("enrollment.url", cfg.Enrollment.URL)
+	v.Set("enrollment.credentials_file", cfg.Enrollment.CredentialsFile)
+	v.Set("enrollment.rotate_before", cfg.Enrollment.RotateBefore.String())
+	v.Set("update.enabled", cfg.Update.Enabled)
+	v.Set("update.manifest_url", cfg.Update.ManifestURL)
+	v.Set("update.public_key", cfg.Update.PublicKey)
+	v.Set("update.check_interval", cfg.Update.CheckInterval.String())
+	v.Set("update.download_timeout", cfg.Update.DownloadTimeout.String())
+	v.Set("update.health_timeout", cfg.Update.HealthTimeout.String())
+	v.Set("commands.enabled", cfg.Commands.Enabled)
+	v.Set("commands.url", cfg.Commands.URL)
+	v.Set("commands.public_key", cfg.Commands.PublicKey)
+	v.Set("commands.actions", cfg.Commands.Actions)
+	v.Set("commands.poll_wait", cfg.Commands.PollWait.String())
+	v.Set("commands.poll_interval", cfg.Commands.PollInterval.String())
+	v.Set("commands.audit_file", cfg.Commands.AuditFile)
+	v.Set("prometheus.enabled", cfg.Prometheus.Enabled)
+	v.Set("prometheus.listen", cfg.Prometheus.Listen)
+	v.Set("prometheus.path", cfg.Prometheus.Path)
+	v.Set("prometheus.mode", cfg.Prometheus.Mode)
+	if len(cfg.Outputs) > 0 {
+		outputs := make([]map[string]interface{}, len(cfg.Outputs))
+		for i, out := range cfg.Outputs {
+			outputs[i] = map[string]interface{}{
+				"name": out.Name,
+				"type": out.Type,
+				"server": map[string]interface{}{
+					"api_url":        out.Server.APIURL,
+					"api_key":        out.Server.APIKey,
+					"server_key":     out.Server.ServerKey,
+					"fallback_urls":  out.Server.FallbackURLs,
+					"srv_record":     out.Server.SRVRecord,
+					"failback_after": out.Server.FailbackAfter.String(),
+				},
+				"sender": senderSettings(out.Sender),
+				"queue":  queueSettings(out.Queue),
+				"filter": filterSettings(out.Filter),
+				"otlp": map[string]interface{}{
+					"endpoint": out.OTLP.Endpoint,
+					"headers":  out.OTLP.Headers,
+				},
+				"influx": map[string]interface{}{
+					"url":    out.Influx.URL,
+					"org":    out.Influx.Org,
+					"bucket": out.Influx.Bucket,
+					"token":  out.Influx.Token,
+				},
+				"graphite": socketSettings(out.Graphite),
+				"statsd":   socketSettings(out.StatsD),
+				"remote_write": map[string]interface{}{
+					"url":          out.RemoteWrite.URL,
+					"username":     out.RemoteWrite.Username,
+					"password":     out.RemoteWrite.Password,
+					"bearer_token": out.RemoteWrite.BearerToken,
+					"labels":       out.RemoteWrite.Labels,
+				},
+				"file": map[string]interface{}{
+					"path":      out.File.Path,
+					"max_size":  out.File.MaxSize,
+					"max_files": out.File.MaxFiles,
+					"max_age":   out.File.MaxAge.String(),
+				},
+			}
+		}
+		v.Set("outputs", outputs)
+	}
 	v.Set("logging.level", cfg.Logging.Level)
 	v.Set("logging.file", cfg.Logging.File)
 
 	return v.WriteConfigAs(path)
 }
 
+func senderSettings(s SenderConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"batch_enabled":         s.BatchEnabled,
+		"batch_size":            s.BatchSize,
+		"batch_timeout":         s.BatchTimeout.String(),
+		"retry_attempts":        s.RetryAttempts,
+		"retry_backoff":         s.RetryBackoff.String(),
+		"retry_max_backoff":     s.RetryMaxBackoff.String(),
+		"breaker_threshold":     s.BreakerThreshold,
+		"breaker_cooldown":      s.BreakerCooldown.String(),
+		"flush_timeout":         s.FlushTimeout.String(),
+		"compression":           s.Compression,
+		"compression_min_bytes": s.CompressionMinBytes,
+	}
+}
+
+func queueSettings(q QueueConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":       q.Enabled,
+		"dir":           q.Dir,
+		"max_bytes":     q.MaxBytes,
+		"max_age":       q.MaxAge.String(),
+		"segment_bytes": q.SegmentBytes,
+	}
+}
+
+func socketSettings(s SocketConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"network": s.Network,
+		"address": s.Address,
+		"prefix":  s.Prefix,
+	}
+}
+
+func collectorSettings(settings map[string]CollectorConfig) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for name, c := range settings {
+		m := map[string]interface{}{
+			"interval": c.Interval.String(),
+			"cron":     c.Cron,
+			"timeout":  c.Timeout.String(),
+		}
+		if c.Enabled != nil {
+			m["enabled"] = *c.Enabled
+		}
+		out[name] = m
+	}
+	return out
+}
+
+func filterSettings(f FilterConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"include": f.Include,
+		"exclude": f.Exclude,
+	}
+}
+
+// filterSections are the payload sections a filter can select
+var filterSections = map[string]bool{
+	"cpu":       true,
+	"memory":    true,
+	"swap":      true,
+	"disk":      true,
+	"network":   true,
+	"processes": true,
+	"uptime":    true,
+}
+
+// ValidateFilter checks that a filter only names known sections
+func ValidateFilter(key string, f FilterConfig) error {
+	for _, section := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if !filterSections[section] {
+			return fmt.Errorf("%s: unknown section %q (use cpu, memory, swap, disk, network, processes or uptime)", key, section)
+		}
+	}
+	return nil
+}
+
+// commandActions are the built-in actions remote commands can run
+var commandActions = map[string]bool{
+	"collect_now":      true,
+	"send_diagnostics": true,
+	"restart":          true,
+	"top_processes":    true,
+}
+
+// loadOutputs decodes the outputs list on top of the top-level sender and
+// queue settings, so an output only needs to set what differs
+func loadOutputs(cfg *Config) error {
+	raw, _ := viper.Get("outputs").([]interface{})
+	if len(raw) == 0 {
+		cfg.Outputs = nil
+		return nil
+	}
+
+	outputs := make([]OutputConfig, len(raw))
+	for i := range outputs {
+		outputs[i] = OutputConfig{
+			Type: "api",
+			Server: ServerConfig{
+				APIKey:        cfg.Server.APIKey,
+				ServerKey:     cfg.Server.ServerKey,
+				FailbackAfter: cfg.Server.FailbackAfter,
+			},
+			Sender: cfg.Sender,
+			Queue:  cfg.Queue,
+		}
+	}
+	if err := viper.UnmarshalKey("outputs", &outputs); err != nil {
+		return fmt.Errorf("error unmarshaling outputs: %w", err)
+	}
+
+	seen := map[string]bool{"api": true}
+	for i := range outputs {
+		out := &outputs[i]
+		key := fmt.Sprintf("outputs[%d]", i)
+
+		if !validOutputName(out.Name) {
+			return fmt.Errorf("%s.name must be set and contain only letters, digits, '-' and '_'", key)
+		}
+		if seen[out.Name] {
+			return fmt.Errorf("%s.name %q is already used", key, out.Name)
+		}
+		seen[out.Name] = true
+
+		switch out.Type {
+		case "api":
+			if out.Server.APIURL == "" {
+				return fmt.Errorf("%s.server.api_url is required", key)
+			}
+		case "otlp":
+			if out.OTLP.Endpoint == "" {
+				return fmt.Errorf("%s.otlp.endpoint is required", key)
+			}
+			if out.Sender.Compression == "zstd" {
+				return fmt.Errorf("%s.sender.compression must be none or gzip for otlp", key)
+			}
+		case "influx":
+			if out.Influx.URL == "" || out.Influx.Bucket == "" {
+				return fmt.Errorf("%s.influx.url and %s.influx.bucket are required", key, key)
+			}
+			if out.Sender.Compression == "zstd" {
+				return fmt.Errorf("%s.sender.compression must be none or gzip for influx", key)
+			}
+		case "graphite":
+			if err := validateSocket(key+".graphite", &out.Graphite, "tcp"); err != nil {
+				return err
+			}
+		case "statsd":
+			if err := validateSocket(key+".statsd", &out.StatsD, "udp"); err != nil {
+				return err
+			}
+		case "remote_write":
+			if out.RemoteWrite.URL == "" {
+				return fmt.Errorf("%s.remote_write.url is required", key)
+			}
+			if out.RemoteWrite.BearerToken != "" && out.RemoteWrite.Username != "" {
+				return fmt.Errorf("%s.remote_write: set either bearer_token or username, not both", key)
+			}
+			// Requests are always snappy-compressed by the sink itself
+			out.Sender.Compression = "none"
+		case "file":
+			if out.File.Path == "" {
+				return fmt.Errorf("%s.file.path is required (use \"-\" for standard output)", key)
+			}
+			if out.File.MaxSize <= 0 {
+				out.File.MaxSize = 10 * 1024 * 1024
+			}
+			if out.File.MaxFiles < 0 || out.File.MaxAge < 0 {
+				return fmt.Errorf("%s.file.max_files and %s.file.max_age cannot be negative", key, key)
+			}
+		default:
+			return fmt.Errorf("%s.type must be one of api, otlp, influx, graphite, statsd, remote_write, file", key)
+		}
+
+		switch out.Sender.Compression {
+		case "", "none", "gzip", "zstd":
+		default:
+			return fmt.Errorf("%s.sender.compression must be one of none, gzip, zstd", key)
+		}
+		if out.Sender.BatchSize <= 0 {
+			out.Sender.BatchSize = 10
+		}
+		if err := ValidateFilter(key+".filter", out.Filter); err != nil {
+			return err
+		}
+
+		// Every output needs a queue directory of its own
+		if out.Queue.Dir == cfg.Queue.Dir {
+			out.Queue.Dir = cfg.Queue.Dir + "-" + out.Name
+		}
+	}
+
+	cfg.Outputs = outputs
+	return nil
+}
+
+// validateSocket checks a graphite or statsd section, filling in the
+// default network and prefix
+func validateSocket(key string, sock *SocketConfig, network string) error {
+	if sock.Address == "" {
+		return fmt.Errorf("%s.address is required", key)
+	}
+	switch sock.Network {
+	case "":
+		sock.Network = network
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("%s.network must be tcp or udp", key)
+	}
+	if sock.Prefix == "" {
+		sock.Prefix = "pingxeno"
+	}
+	return nil
+}
+
+func validOutputName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+// Package exporter holds what the third-party output formats share: a
+// flattened view of a payload as measurements with tags and fields, the
+// Encoder interface for line-based formats, and a sink that writes encoded
+// payloads to a TCP or UDP socket.
+package exporter
+
+import (
+	"strconv"
+
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Encoder turns a payload into a line-based wire format, appending the
+// encoded lines to dst
+type Encoder interface {
+	Encode(dst []byte, payload *protocol.MetricsPayload) []byte
+}
+
+// Tag is a key/value pair identifying a series
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field is one value of a measurement. Int marks values that are counts
+// or byte sizes rather than ratios.
+type Field struct {
+	Name  string
+	Value float64
+	Int   bool
+}
+
+// Point is one measurement taken from a payload section, such as the usage
+// of a single disk partition
+type Point struct {
+	Measurement string
+	Tags        []Tag // Tags specific to the point, in addition to the identity tags
+	Fields      []Field
+}
+
+// IdentityTags returns the tags identifying the host a payload came from
+func IdentityTags(p *protocol.MetricsPayload) []Tag {
+	var tags []Tag
+	for _, tag := range []Tag{
+		{"host", p.Hostname},
+		{"agent_id", p.AgentID},
+		{"os_type", p.OSType},
+		{"machine_id", p.MachineID},
+	} {
+		if tag.Value != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Points flattens the cpu, memory, swap, disk, network, process and uptime
+// sections of a payload. Sections missing from the payload are left out.
+func Points(p *protocol.MetricsPayload) []Point {
+	var points []Point
+	add := func(measurement string, tags []Tag, fields []Field) {
+		if len(fields) > 0 {
+			points = append(points, Point{Measurement: measurement, Tags: tags, Fields: fields})
+		}
+	}
+
+	add("cpu", nil, fields(
+		ratio("usage_percent", p.CPUUsagePercent),
+		count("cores", p.CPUCores),
+		ratio("load1", p.CPULoad1Min),
+		ratio("load5", p.CPULoad5Min),
+		ratio("load15", p.CPULoad15Min),
+		ratio("user_percent", p.CPUUserPercent),
+		ratio("system_percent", p.CPUSystemPercent),
+		ratio("nice_percent", p.CPUNicePercent),
+		ratio("idle_percent", p.CPUIdlePercent),
+		ratio("iowait_percent", p.CPUIowaitPercent),
+		ratio("irq_percent", p.CPUIrqPercent),
+		ratio("softirq_percent", p.CPUSoftirqPercent),
+		ratio("steal_percent", p.CPUStealPercent),
+		ratio("guest_percent", p.CPUGuestPercent),
+	))
+	for _, c := range p.CPUPerCore {
+		add("cpu_core", []Tag{{"cpu", strconv.Itoa(c.Core)}}, []Field{
+			{Name: "usage_percent", Value: c.UsagePercent},
+			{Name: "user_percent", Value: c.UserPercent},
+			{Name: "system_percent", Value: c.SystemPercent},
+			{Name: "nice_percent", Value: c.NicePercent},
+			{Name: "idle_percent", Value: c.IdlePercent},
+			{Name: "iowait_percent", Value: c.IowaitPercent},
+			{Name: "irq_percent", Value: c.IrqPercent},
+			{Name: "softirq_percent", Value: c.SoftirqPercent},
+			{Name: "steal_percent", Value: c.StealPercent},
+			{Name: "guest_percent", Value: c.GuestPercent},
+		})
+	}
+	add("memory", nil, fields(
+		byteSize("total_bytes", p.MemoryTotalBytes),
+		byteSize("used_bytes", p.MemoryUsedBytes),
+		byteSize("free_bytes", p.MemoryFreeBytes),
+		ratio("usage_percent", p.MemoryUsagePercent),
+	))
+	add("swap", nil, fields(
+		byteSize("total_bytes", p.SwapTotalBytes),
+		byteSize("used_bytes", p.SwapUsedBytes),
+		byteSize("free_bytes", p.SwapFreeBytes),
+		ratio("usage_percent", p.SwapUsagePercent),
+	))
+
+	for _, d := range p.DiskUsage {
+		add("disk", []Tag{{"device", d.Device}, {"mountpoint", d.MountPoint}, {"fstype", d.FSType}}, []Field{
+			{Name: "total_bytes", Value: float64(d.TotalBytes), Int: true},
+			{Name: "used_bytes", Value: float64(d.UsedBytes), Int: true},
+			{Name: "free_bytes", Value: float64(d.FreeBytes), Int: true},
+			{Name: "usage_percent", Value: d.UsagePercent},
+		})
+	}
+
+	for _, n := range p.NetworkInterfaces {
+		add("network", []Tag{{"interface", n.Name}}, []Field{
+			{Name: "bytes_sent", Value: float64(n.BytesSent), Int: true},
+			{Name: "bytes_received", Value: float64(n.BytesReceived), Int: true},
+			{Name: "packets_sent", Value: float64(n.PacketsSent), Int: true},
+			{Name: "packets_received", Value: float64(n.PacketsReceived), Int: true},
+			{Name: "errors_in", Value: float64(n.ErrorsIn), Int: true},
+			{Name: "errors_out", Value: float64(n.ErrorsOut), Int: true},
+			{Name: "drop_in", Value: float64(n.DropIn), Int: true},
+			{Name: "drop_out", Value: float64(n.DropOut), Int: true},
+		})
+	}
+
+	add("processes", nil, fields(
+		count("total", p.ProcessesTotal),
+		count("running", p.ProcessesRunning),
+		count("sleeping", p.ProcessesSleeping),
+	))
+	for _, proc := range p.Processes {
+		add("process", []Tag{{"pid", strconv.Itoa(proc.PID)}, {"name", proc.Name}, {"user", proc.User}}, []Field{
+			{Name: "cpu_percent", Value: proc.CPUPercent},
+			{Name: "memory_bytes", Value: float64(proc.MemoryBytes), Int: true},
+			{Name: "memory_percent", Value: proc.MemoryPercent},
+		})
+	}
+
+	add("system", nil, fields(count("uptime_seconds", p.UptimeSeconds)))
+
+	return points
+}
+
+// fields drops the fields whose payload value was missing
+func fields(all ...*Field) []Field {
+	var out []Field
+	for _, f := range all {
+		if f != nil {
+			out = append(out, *f)
+		}
+	}
+	return out
+}
+
+func ratio(name string, v *float64) *Field {
+	if v == nil {
+		return nil
+	}
+	return &Field{Name: name, Value: *v}
+}
+
+func byteSize(name string, v *int64) *Field {
+	if v == nil {
+		return nil
+	}
+	return &Field{Name: name, Value: float64(*v), Int: true}
+}
+
+func count(name string, v *int) *Field {
+	if v == nil {
+		return nil
+	}
+	return &Field{Name: name, Value: float64(*v), Int: true}
+}
+
+// FormatValue formats a field value, without a decimal point for integers
+func FormatValue(f Field) string {
+	if f.Int {
+		return strconv.FormatInt(int64(f.Value), 10)
+	}
+	return strconv.FormatFloat(f.Value, 'f', -1, 64)
+}
@@ -0,0 +1,65 @@
+// Package graphite encodes metrics in the Graphite plaintext protocol.
+package graphite
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pingxeno/agent/exporter"
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Encoder writes one tagged line per field, with the measurement and field
+// name as the path and the identity and point tags as Graphite tags:
+//
+//	pingxeno.disk.used_bytes;host=web1;agent_id=abc;mountpoint=/ 123 1700000000
+type Encoder struct {
+	Prefix string
+}
+
+// Encode implements exporter.Encoder
+func (e Encoder) Encode(dst []byte, p *protocol.MetricsPayload) []byte {
+	identity := exporter.IdentityTags(p)
+	timestamp := strconv.FormatInt(p.RecordedAt.Unix(), 10)
+
+	for _, point := range exporter.Points(p) {
+		for _, field := range point.Fields {
+			if e.Prefix != "" {
+				dst = append(dst, pathSanitizer.Replace(e.Prefix)...)
+				dst = append(dst, '.')
+			}
+			dst = append(dst, pathSanitizer.Replace(point.Measurement)...)
+			dst = append(dst, '.')
+			dst = append(dst, pathSanitizer.Replace(field.Name)...)
+
+			for _, tags := range [][]exporter.Tag{identity, point.Tags} {
+				for _, tag := range tags {
+					if tag.Value == "" {
+						continue
+					}
+					dst = append(dst, ';')
+					dst = append(dst, tagSanitizer.Replace(tag.Key)...)
+					dst = append(dst, '=')
+					dst = append(dst, tagSanitizer.Replace(tag.Value)...)
+				}
+			}
+
+			dst = append(dst, ' ')
+			dst = append(dst, exporter.FormatValue(field)...)
+			dst = append(dst, ' ')
+			dst = append(dst, timestamp...)
+			dst = append(dst, '\n')
+		}
+	}
+	return dst
+}
+
+var (
+	// Path nodes may not contain whitespace or ';'. Dots are kept on
+	// purpose: they separate nodes, so a prefix such as "ops.pingxeno" adds
+	// levels to the hierarchy. Measurement and field names never contain one.
+	pathSanitizer = strings.NewReplacer(" ", "_", ";", "_", "\n", "_")
+	// Tag values may not contain ';' or '~', and no part of a line may
+	// contain whitespace
+	tagSanitizer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "=", "_", "\n", "_")
+)
@@ -0,0 +1,121 @@
+// Package influx encodes metrics as InfluxDB line protocol and writes them
+// to the InfluxDB v2 HTTP API.
+package influx
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/exporter"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Encoder writes one line per measurement with nanosecond timestamps:
+//
+//	disk,host=web1,agent_id=abc,device=/dev/sda1,mountpoint=/ used_bytes=123i,usage_percent=41.2 1700000000000000000
+type Encoder struct{}
+
+// Encode implements exporter.Encoder
+func (Encoder) Encode(dst []byte, p *protocol.MetricsPayload) []byte {
+	identity := exporter.IdentityTags(p)
+	timestamp := strconv.FormatInt(p.RecordedAt.UnixNano(), 10)
+
+	for _, point := range exporter.Points(p) {
+		dst = append(dst, measurementEscaper.Replace(point.Measurement)...)
+		for _, tags := range [][]exporter.Tag{identity, point.Tags} {
+			for _, tag := range tags {
+				if tag.Value == "" {
+					// Empty tag values are not allowed
+					continue
+				}
+				dst = append(dst, ',')
+				dst = append(dst, tagEscaper.Replace(tag.Key)...)
+				dst = append(dst, '=')
+				dst = append(dst, tagEscaper.Replace(tag.Value)...)
+			}
+		}
+		for i, field := range point.Fields {
+			if i == 0 {
+				dst = append(dst, ' ')
+			} else {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, tagEscaper.Replace(field.Name)...)
+			dst = append(dst, '=')
+			dst = append(dst, exporter.FormatValue(field)...)
+			if field.Int {
+				dst = append(dst, 'i')
+			}
+		}
+		dst = append(dst, ' ')
+		dst = append(dst, timestamp...)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// Sink writes payloads to the /api/v2/write endpoint. It implements
+// sender.Sink, so it gets the same queueing and retries as the API output.
+type Sink struct {
+	writeURL string
+	token    string
+	poster   *sender.Poster
+	logger   *zap.Logger
+}
+
+// NewSink creates a sink writing to the bucket configured in cfg
+func NewSink(cfg config.InfluxConfig, poster *sender.Poster, logger *zap.Logger) *Sink {
+	query := url.Values{}
+	query.Set("org", cfg.Org)
+	query.Set("bucket", cfg.Bucket)
+	query.Set("precision", "ns")
+
+	return &Sink{
+		writeURL: strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + query.Encode(),
+		token:    cfg.Token,
+		poster:   poster,
+		logger:   logger,
+	}
+}
+
+// SendMetrics writes a single payload
+func (s *Sink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	_, err := s.SendBatch(ctx, []*protocol.MetricsPayload{payload})
+	return err
+}
+
+// SendBatch writes several payloads in one request. InfluxDB accepts or
+// rejects a write as a whole, so there are no per-item errors.
+func (s *Sink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	var body []byte
+	for _, payload := range payloads {
+		body = Encoder{}.Encode(body, payload)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		header.Set("Authorization", "Token "+s.token)
+	}
+
+	if _, err := s.poster.Post(ctx, s.writeURL, body, header); err != nil {
+		return nil, err
+	}
+	return make([]error, len(payloads)), nil
+}
+
+// Close releases idle connections
+func (s *Sink) Close() error {
+	return s.poster.Close()
+}
@@ -0,0 +1,174 @@
+// Package ndjson writes payloads as newline-delimited JSON, one payload per
+// line, for hosts whose metrics are picked up by a log shipper or copied
+// off by hand, and reads such files back for replaying.
+package ndjson
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/internal/logger"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Stdout is the path that selects standard output instead of a file
+const Stdout = "-"
+
+// Sink appends payloads to a file, rotating it by size, or to standard
+// output. It implements sender.Sink. The file is opened on the first write,
+// so one-shot commands never create it.
+type Sink struct {
+	config config.FileConfig
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	writer *logger.RotatingWriter
+}
+
+// NewSink creates a sink writing to the path configured in cfg
+func NewSink(cfg config.FileConfig, logger *zap.Logger) *Sink {
+	return &Sink{
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// SendMetrics writes a single payload
+func (s *Sink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	results, err := s.SendBatch(ctx, []*protocol.MetricsPayload{payload})
+	if err != nil {
+		return err
+	}
+	return results[0]
+}
+
+// SendBatch writes several payloads in one write, so a batch is never split
+// across rotated files. A payload that cannot be encoded is rejected on its
+// own.
+func (s *Sink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	results := make([]error, len(payloads))
+	var data []byte
+	for i, payload := range payloads {
+		// Payloads queued by older agents may still carry the server key
+		unkeyed := *payload
+		unkeyed.ServerKey = ""
+
+		line, err := json.Marshal(&unkeyed)
+		if err != nil {
+			results[i] = &sender.ItemError{Index: i, Message: err.Error()}
+			continue
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if len(data) == 0 {
+		return results, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.Path == Stdout {
+		if _, err := os.Stdout.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to write to stdout: %w", err)
+		}
+		return results, nil
+	}
+
+	if s.writer == nil {
+		w, err := logger.NewRotatingWriterWithOptions(s.config.Path, logger.RotateOptions{
+			MaxSize:  s.config.MaxSize,
+			MaxFiles: s.config.MaxFiles,
+			MaxAge:   s.config.MaxAge,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", s.config.Path, err)
+		}
+		s.writer = w
+	}
+
+	if _, err := s.writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write to %s: %w", s.config.Path, err)
+	}
+	if err := s.writer.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync %s: %w", s.config.Path, err)
+	}
+	return results, nil
+}
+
+// Close closes the file
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+// maxLine bounds a single line, well above any payload the agent writes
+const maxLine = 64 * 1024 * 1024
+
+// Reader reads payloads written by a Sink
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewReader creates a reader over r
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next payload, or io.EOF at the end of the input. A line
+// that cannot be decoded, such as one cut short by a crash, returns a
+// *LineError; reading can continue after it.
+func (r *Reader) Next() (*protocol.MetricsPayload, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var payload protocol.MetricsPayload
+		if err := json.Unmarshal(line, &payload); err != nil {
+			return nil, &LineError{Line: r.line, Err: err}
+		}
+		return &payload, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Line returns the number of the line read last
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// LineError reports a line that is not a valid payload
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
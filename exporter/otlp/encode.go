@@ -0,0 +1,261 @@
+package otlp
+
+import (
+	"math"
+	"time"
+
+	"github.com/pingxeno/agent/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from opentelemetry/proto/collector/metrics/v1 and
+// opentelemetry/proto/metrics/v1
+const (
+	fieldRequestResourceMetrics = 1
+
+	fieldResourceMetricsResource = 1
+	fieldResourceMetricsScope    = 2
+
+	fieldResourceAttributes = 1
+
+	fieldScopeMetricsScope   = 1
+	fieldScopeMetricsMetrics = 2
+
+	fieldScopeName    = 1
+	fieldScopeVersion = 2
+
+	fieldKeyValueKey   = 1
+	fieldKeyValueValue = 2
+
+	fieldAnyValueString = 1
+	fieldAnyValueInt    = 3
+
+	fieldMetricName        = 1
+	fieldMetricDescription = 2
+	fieldMetricUnit        = 3
+	fieldMetricGauge       = 5
+	fieldMetricSum         = 7
+
+	fieldGaugeDataPoints = 1
+
+	fieldSumDataPoints  = 1
+	fieldSumTemporality = 2
+	fieldSumMonotonic   = 3
+
+	fieldPointStartTime  = 2
+	fieldPointTime       = 3
+	fieldPointAsDouble   = 4
+	fieldPointAttributes = 7
+
+	fieldResponsePartialSuccess = 1
+	fieldPartialRejected        = 1
+	fieldPartialMessage         = 2
+)
+
+// aggregationCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+const aggregationCumulative = 2
+
+// scopeName identifies the agent as the instrumentation scope
+const scopeName = "github.com/pingxeno/agent"
+
+type metricKind int
+
+const (
+	kindGauge   metricKind = iota
+	kindSum                // Non-monotonic cumulative sum (an up-down counter)
+	kindCounter            // Monotonic cumulative sum
+)
+
+// attribute is a string or integer key/value pair
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+type point struct {
+	attrs []attribute
+	value float64
+}
+
+type metric struct {
+	name        string
+	description string
+	unit        string
+	kind        metricKind
+	points      []point
+}
+
+// encodeRequest builds an ExportMetricsServiceRequest with one
+// ResourceMetrics per payload
+func encodeRequest(payloads []*protocol.MetricsPayload) []byte {
+	var req []byte
+	for _, p := range payloads {
+		req = appendMessage(req, fieldRequestResourceMetrics, encodeResourceMetrics(p))
+	}
+	return req
+}
+
+func encodeResourceMetrics(p *protocol.MetricsPayload) []byte {
+	var resource []byte
+	for _, attr := range resourceAttributes(p) {
+		resource = appendMessage(resource, fieldResourceAttributes, encodeAttribute(attr))
+	}
+
+	var scope []byte
+	scope = appendString(scope, fieldScopeName, scopeName)
+	if p.AgentVersion != "" {
+		scope = appendString(scope, fieldScopeVersion, p.AgentVersion)
+	}
+
+	timestamp := uint64(p.RecordedAt.UnixNano())
+	// Counters and usage sums are cumulative since boot
+	var start uint64
+	if p.UptimeSeconds != nil {
+		start = uint64(p.RecordedAt.Add(-time.Duration(*p.UptimeSeconds) * time.Second).UnixNano())
+	}
+
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, fieldScopeMetricsScope, scope)
+	for _, m := range metrics(p) {
+		if len(m.points) > 0 {
+			scopeMetrics = appendMessage(scopeMetrics, fieldScopeMetricsMetrics, encodeMetric(m, start, timestamp))
+		}
+	}
+
+	var rm []byte
+	rm = appendMessage(rm, fieldResourceMetricsResource, resource)
+	rm = appendMessage(rm, fieldResourceMetricsScope, scopeMetrics)
+	return rm
+}
+
+// resourceAttributes maps the payload identity to semantic convention
+// resource attributes
+func resourceAttributes(p *protocol.MetricsPayload) []attribute {
+	attrs := []attribute{{"service.name", "pingxeno-agent"}}
+	for _, a := range []attribute{
+		{"service.instance.id", p.AgentID},
+		{"service.version", p.AgentVersion},
+		{"host.name", p.Hostname},
+		{"host.id", p.MachineID},
+		{"os.type", p.OSType},
+		{"os.description", p.OSVersion},
+	} {
+		if a.value != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
+
+func encodeMetric(m metric, start, timestamp uint64) []byte {
+	var points []byte
+	for _, pt := range m.points {
+		var dp []byte
+		if m.kind != kindGauge && start != 0 {
+			dp = appendFixed64(dp, fieldPointStartTime, start)
+		}
+		dp = appendFixed64(dp, fieldPointTime, timestamp)
+		dp = appendFixed64(dp, fieldPointAsDouble, math.Float64bits(pt.value))
+		for _, attr := range pt.attrs {
+			dp = appendMessage(dp, fieldPointAttributes, encodeAttribute(attr))
+		}
+		points = appendMessage(points, fieldGaugeDataPoints, dp)
+	}
+
+	var out []byte
+	out = appendString(out, fieldMetricName, m.name)
+	out = appendString(out, fieldMetricDescription, m.description)
+	out = appendString(out, fieldMetricUnit, m.unit)
+
+	if m.kind == kindGauge {
+		return appendMessage(out, fieldMetricGauge, points)
+	}
+
+	// Sum shares the data point field number with Gauge
+	sum := append([]byte{}, points...)
+	sum = protowire.AppendTag(sum, fieldSumTemporality, protowire.VarintType)
+	sum = protowire.AppendVarint(sum, aggregationCumulative)
+	if m.kind == kindCounter {
+		sum = protowire.AppendTag(sum, fieldSumMonotonic, protowire.VarintType)
+		sum = protowire.AppendVarint(sum, 1)
+	}
+	return appendMessage(out, fieldMetricSum, sum)
+}
+
+func encodeAttribute(attr attribute) []byte {
+	var value []byte
+	switch v := attr.value.(type) {
+	case string:
+		value = appendString(value, fieldAnyValueString, v)
+	case int64:
+		value = protowire.AppendTag(value, fieldAnyValueInt, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(v))
+	}
+
+	var kv []byte
+	kv = appendString(kv, fieldKeyValueKey, attr.key)
+	kv = appendMessage(kv, fieldKeyValueValue, value)
+	return kv
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// partialSuccess extracts the rejected data point count and message from
+// an ExportMetricsServiceResponse
+func partialSuccess(resp []byte) (rejected int64, message string) {
+	forEachField(resp, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+		if num != fieldResponsePartialSuccess || typ != protowire.BytesType {
+			return
+		}
+		forEachField(value, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+			switch {
+			case num == fieldPartialRejected && typ == protowire.VarintType:
+				rejected = int64(varint)
+			case num == fieldPartialMessage && typ == protowire.BytesType:
+				message = string(value)
+			}
+		})
+	})
+	return rejected, message
+}
+
+// forEachField walks the top-level fields of a protobuf message, stopping
+// at the first malformed one
+func forEachField(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+
+		var value []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		fn(num, typ, value, varint)
+	}
+}
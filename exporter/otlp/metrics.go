@@ -0,0 +1,187 @@
+package otlp
+
+import (
+	"github.com/pingxeno/agent/protocol"
+)
+
+// metrics maps a payload to OpenTelemetry system and process metrics,
+// following the semantic conventions for names, units and attributes.
+// CPU utilisation across all CPUs, which the conventions have no metric
+// for, is exported under pingxeno.* so that system.cpu.utilization only
+// has per-CPU points. Sections missing from the payload produce no data
+// points.
+func metrics(p *protocol.MetricsPayload) []metric {
+	var out []metric
+	add := func(name, description, unit string, kind metricKind, points ...point) {
+		out = append(out, metric{name: name, description: description, unit: unit, kind: kind, points: points})
+	}
+	single := func(value interface{}, scale float64, attrs ...attribute) []point {
+		if v, ok := number(value); ok {
+			return []point{{attrs: attrs, value: v * scale}}
+		}
+		return nil
+	}
+
+	// Guest time is left out of the modes as it is already part of user and
+	// nice, so the modes of a CPU add up to one
+	var cpuModes []point
+	for _, m := range []struct {
+		mode  string
+		value *float64
+	}{
+		{"user", p.CPUUserPercent},
+		{"system", p.CPUSystemPercent},
+		{"nice", p.CPUNicePercent},
+		{"idle", p.CPUIdlePercent},
+		{"iowait", p.CPUIowaitPercent},
+		{"interrupt", p.CPUIrqPercent},
+		{"softirq", p.CPUSoftirqPercent},
+		{"steal", p.CPUStealPercent},
+	} {
+		cpuModes = append(cpuModes, single(m.value, 0.01, attribute{"cpu.mode", m.mode})...)
+	}
+	var cpuUtil []point
+	for _, c := range p.CPUPerCore {
+		core := attribute{"cpu.logical_number", int64(c.Core)}
+		for _, m := range []struct {
+			mode  string
+			value float64
+		}{
+			{"user", c.UserPercent},
+			{"system", c.SystemPercent},
+			{"nice", c.NicePercent},
+			{"idle", c.IdlePercent},
+			{"iowait", c.IowaitPercent},
+			{"interrupt", c.IrqPercent},
+			{"softirq", c.SoftirqPercent},
+			{"steal", c.StealPercent},
+		} {
+			cpuUtil = append(cpuUtil, point{[]attribute{core, {"cpu.mode", m.mode}}, m.value / 100})
+		}
+	}
+	add("system.cpu.utilization", "CPU utilisation by CPU and mode.", "1", kindGauge,
+		cpuUtil...)
+	add("pingxeno.cpu.utilization", "CPU utilisation across all CPUs, excluding idle time.", "1", kindGauge,
+		single(p.CPUUsagePercent, 0.01)...)
+	add("pingxeno.cpu.mode.utilization", "CPU utilisation across all CPUs by mode.", "1", kindGauge,
+		cpuModes...)
+	add("system.cpu.logical.count", "Number of logical CPUs.", "{cpu}", kindSum,
+		single(p.CPUCores, 1)...)
+	add("system.cpu.load_average.1m", "1-minute load average.", "{thread}", kindGauge,
+		single(p.CPULoad1Min, 1)...)
+	add("system.cpu.load_average.5m", "5-minute load average.", "{thread}", kindGauge,
+		single(p.CPULoad5Min, 1)...)
+	add("system.cpu.load_average.15m", "15-minute load average.", "{thread}", kindGauge,
+		single(p.CPULoad15Min, 1)...)
+
+	add("system.memory.limit", "Total physical memory.", "By", kindSum,
+		single(p.MemoryTotalBytes, 1)...)
+	add("system.memory.usage", "Physical memory by state.", "By", kindSum,
+		append(single(p.MemoryUsedBytes, 1, attribute{"system.memory.state", "used"}),
+			single(p.MemoryFreeBytes, 1, attribute{"system.memory.state", "free"})...)...)
+	add("system.memory.utilization", "Share of physical memory in use.", "1", kindGauge,
+		single(p.MemoryUsagePercent, 0.01, attribute{"system.memory.state", "used"})...)
+
+	add("system.paging.limit", "Total swap space.", "By", kindSum,
+		single(p.SwapTotalBytes, 1)...)
+	add("system.paging.usage", "Swap space by state.", "By", kindSum,
+		append(single(p.SwapUsedBytes, 1, attribute{"system.paging.state", "used"}),
+			single(p.SwapFreeBytes, 1, attribute{"system.paging.state", "free"})...)...)
+	add("system.paging.utilization", "Share of swap space in use.", "1", kindGauge,
+		single(p.SwapUsagePercent, 0.01, attribute{"system.paging.state", "used"})...)
+
+	var fsLimit, fsUsage, fsUtil []point
+	for _, d := range p.DiskUsage {
+		attrs := []attribute{
+			{"system.device", d.Device},
+			{"system.filesystem.mountpoint", d.MountPoint},
+			{"system.filesystem.type", d.FSType},
+		}
+		fsLimit = append(fsLimit, point{attrs: attrs, value: float64(d.TotalBytes)})
+		fsUsage = append(fsUsage,
+			point{attrs: withAttr(attrs, "system.filesystem.state", "used"), value: float64(d.UsedBytes)},
+			point{attrs: withAttr(attrs, "system.filesystem.state", "free"), value: float64(d.FreeBytes)},
+		)
+		fsUtil = append(fsUtil, point{attrs: attrs, value: d.UsagePercent / 100})
+	}
+	add("system.filesystem.limit", "Filesystem size.", "By", kindSum, fsLimit...)
+	add("system.filesystem.usage", "Filesystem space by state.", "By", kindSum, fsUsage...)
+	add("system.filesystem.utilization", "Share of filesystem space in use.", "1", kindGauge, fsUtil...)
+
+	var netIO, netPackets, netErrors, netDropped []point
+	for _, n := range p.NetworkInterfaces {
+		tx := []attribute{{"network.interface.name", n.Name}, {"network.io.direction", "transmit"}}
+		rx := []attribute{{"network.interface.name", n.Name}, {"network.io.direction", "receive"}}
+		netIO = append(netIO, point{tx, float64(n.BytesSent)}, point{rx, float64(n.BytesReceived)})
+		netPackets = append(netPackets, point{tx, float64(n.PacketsSent)}, point{rx, float64(n.PacketsReceived)})
+		netErrors = append(netErrors, point{tx, float64(n.ErrorsOut)}, point{rx, float64(n.ErrorsIn)})
+		netDropped = append(netDropped, point{tx, float64(n.DropOut)}, point{rx, float64(n.DropIn)})
+	}
+	add("system.network.io", "Bytes transferred.", "By", kindCounter, netIO...)
+	add("system.network.packets", "Packets transferred.", "{packet}", kindCounter, netPackets...)
+	add("system.network.errors", "Transfer errors.", "{error}", kindCounter, netErrors...)
+	add("system.network.dropped", "Packets dropped.", "{packet}", kindCounter, netDropped...)
+
+	if p.ProcessesTotal != nil {
+		running, sleeping := 0, 0
+		if p.ProcessesRunning != nil {
+			running = *p.ProcessesRunning
+		}
+		if p.ProcessesSleeping != nil {
+			sleeping = *p.ProcessesSleeping
+		}
+		other := *p.ProcessesTotal - running - sleeping
+		if other < 0 {
+			other = 0
+		}
+		add("system.process.count", "Number of processes by status.", "{process}", kindSum,
+			point{[]attribute{{"process.status", "running"}}, float64(running)},
+			point{[]attribute{{"process.status", "sleeping"}}, float64(sleeping)},
+			point{[]attribute{{"process.status", "other"}}, float64(other)},
+		)
+	}
+
+	var procCPU, procMem, procMemUtil []point
+	for _, proc := range p.Processes {
+		attrs := []attribute{
+			{"process.pid", int64(proc.PID)},
+			{"process.executable.name", proc.Name},
+			{"process.owner", proc.User},
+		}
+		procCPU = append(procCPU, point{attrs, proc.CPUPercent / 100})
+		procMem = append(procMem, point{attrs, float64(proc.MemoryBytes)})
+		procMemUtil = append(procMemUtil, point{attrs, proc.MemoryPercent / 100})
+	}
+	add("process.cpu.utilization", "CPU utilisation of a process.", "1", kindGauge, procCPU...)
+	add("process.memory.usage", "Resident memory of a process.", "By", kindSum, procMem...)
+	add("process.memory.utilization", "Share of physical memory used by a process.", "1", kindGauge, procMemUtil...)
+
+	add("system.uptime", "Time since the host booted.", "s", kindGauge,
+		single(p.UptimeSeconds, 1)...)
+
+	return out
+}
+
+// withAttr returns a copy of attrs with one more attribute
+func withAttr(attrs []attribute, key, value string) []attribute {
+	return append(append(make([]attribute, 0, len(attrs)+1), attrs...), attribute{key, value})
+}
+
+// number dereferences the optional payload fields
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case *float64:
+		if v != nil {
+			return *v, true
+		}
+	case *int64:
+		if v != nil {
+			return float64(*v), true
+		}
+	case *int:
+		if v != nil {
+			return float64(*v), true
+		}
+	}
+	return 0, false
+}
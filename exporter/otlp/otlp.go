@@ -0,0 +1,65 @@
+// Package otlp exports metrics to an OpenTelemetry collector over OTLP/HTTP
+// using the binary protobuf encoding.
+package otlp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Sink sends payloads as OTLP ExportMetricsServiceRequests. It implements
+// sender.Sink, so it gets the same queueing and retries as the API output.
+type Sink struct {
+	config config.OTLPConfig
+	poster *sender.Poster
+	logger *zap.Logger
+}
+
+// NewSink creates an OTLP sink posting through poster
+func NewSink(cfg config.OTLPConfig, poster *sender.Poster, logger *zap.Logger) *Sink {
+	return &Sink{
+		config: cfg,
+		poster: poster,
+		logger: logger,
+	}
+}
+
+// SendMetrics exports a single payload
+func (s *Sink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	_, err := s.SendBatch(ctx, []*protocol.MetricsPayload{payload})
+	return err
+}
+
+// SendBatch exports several payloads in one request. The collector either
+// accepts the request as a whole or fails it, so there are no per-item errors.
+func (s *Sink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range s.config.Headers {
+		header.Set(name, value)
+	}
+
+	resp, err := s.poster.Post(ctx, s.config.Endpoint, encodeRequest(payloads), header)
+	if err != nil {
+		return nil, err
+	}
+
+	if rejected, message := partialSuccess(resp); rejected > 0 || message != "" {
+		s.logger.Warn("Collector rejected some data points",
+			zap.Int64("rejected", rejected),
+			zap.String("message", message),
+		)
+	}
+
+	return make([]error, len(payloads)), nil
+}
+
+// Close releases idle connections
+func (s *Sink) Close() error {
+	return s.poster.Close()
+}
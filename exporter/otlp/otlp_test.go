@@ -0,0 +1,312 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// exported is a data point as a collector would read it back
+type exported struct {
+	resource map[string]interface{}
+	metric   string
+	unit     string
+	attrs    map[string]interface{}
+	value    float64
+}
+
+// collector is a stub OTLP/HTTP receiver that decodes every
+// ExportMetricsServiceRequest it is sent. The field numbers are spelled out
+// from the opentelemetry-proto definitions rather than taken from encode.go.
+type collector struct {
+	mu     sync.Mutex
+	points []exported
+	header http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = r.Header.Clone()
+
+	// ExportMetricsServiceRequest.resource_metrics = 1
+	walk(body, func(num protowire.Number, rm []byte) {
+		if num != 1 {
+			return
+		}
+		resource := make(map[string]interface{})
+		walk(rm, func(num protowire.Number, value []byte) {
+			switch num {
+			case 1: // ResourceMetrics.resource, Resource.attributes = 1
+				walk(value, func(num protowire.Number, kv []byte) {
+					if num == 1 {
+						key, v := decodeKeyValue(kv)
+						resource[key] = v
+					}
+				})
+			case 2: // ResourceMetrics.scope_metrics, ScopeMetrics.metrics = 2
+				walk(value, func(num protowire.Number, m []byte) {
+					if num == 2 {
+						c.points = append(c.points, decodeMetric(resource, m)...)
+					}
+				})
+			}
+		})
+	})
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// decodeMetric returns the data points of a Gauge or Sum metric
+func decodeMetric(resource map[string]interface{}, m []byte) []exported {
+	var name, unit string
+	var points []exported
+	walk(m, func(num protowire.Number, value []byte) {
+		switch num {
+		case 1:
+			name = string(value)
+		case 3:
+			unit = string(value)
+		case 5, 7: // gauge, sum; data_points = 1 in both
+			walk(value, func(num protowire.Number, dp []byte) {
+				if num == 1 {
+					points = append(points, decodePoint(dp))
+				}
+			})
+		}
+	})
+	for i := range points {
+		points[i].resource = resource
+		points[i].metric = name
+		points[i].unit = unit
+	}
+	return points
+}
+
+// decodePoint reads a NumberDataPoint's as_double (4) and attributes (7)
+func decodePoint(dp []byte) exported {
+	pt := exported{attrs: make(map[string]interface{})}
+	for len(dp) > 0 {
+		num, typ, n := protowire.ConsumeTag(dp)
+		dp = dp[n:]
+		switch {
+		case num == 4 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(dp)
+			pt.value = math.Float64frombits(v)
+			dp = dp[n:]
+		case num == 7 && typ == protowire.BytesType:
+			kv, n := protowire.ConsumeBytes(dp)
+			key, v := decodeKeyValue(kv)
+			pt.attrs[key] = v
+			dp = dp[n:]
+		default:
+			dp = dp[protowire.ConsumeFieldValue(num, typ, dp):]
+		}
+	}
+	return pt
+}
+
+// decodeKeyValue reads a KeyValue with a string (1) or int (3) AnyValue
+func decodeKeyValue(kv []byte) (key string, value interface{}) {
+	walk(kv, func(num protowire.Number, b []byte) {
+		switch num {
+		case 1:
+			key = string(b)
+		case 2:
+			for len(b) > 0 {
+				num, typ, n := protowire.ConsumeTag(b)
+				b = b[n:]
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					s, n := protowire.ConsumeString(b)
+					value = s
+					b = b[n:]
+				case num == 3 && typ == protowire.VarintType:
+					v, n := protowire.ConsumeVarint(b)
+					value = int64(v)
+					b = b[n:]
+				default:
+					b = b[protowire.ConsumeFieldValue(num, typ, b):]
+				}
+			}
+		}
+	})
+	return key, value
+}
+
+// walk calls fn with every length-delimited field of a message
+func walk(b []byte, fn func(num protowire.Number, value []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			b = b[protowire.ConsumeFieldValue(num, typ, b):]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		fn(num, value)
+	}
+}
+
+// find returns the points of a metric
+func (c *collector) find(name string) []exported {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []exported
+	for _, pt := range c.points {
+		if pt.metric == name {
+			out = append(out, pt)
+		}
+	}
+	return out
+}
+
+func newTestSink(t *testing.T, c *collector) *Sink {
+	t.Helper()
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+
+	poster, err := sender.NewPoster(config.DefaultConfig(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { poster.Close() })
+
+	cfg := config.OTLPConfig{
+		Endpoint: srv.URL + "/v1/metrics",
+		Headers:  map[string]string{"X-Tenant": "ops"},
+	}
+	return NewSink(cfg, poster, zap.NewNop())
+}
+
+func testPayload() *protocol.MetricsPayload {
+	used, free := int64(3<<30), int64(1<<30)
+	memPercent := 75.0
+	busy, user, idle := 40.0, 30.0, 60.0
+	return &protocol.MetricsPayload{
+		AgentID:            "agent-1",
+		Hostname:           "web-1",
+		OSType:             "linux",
+		RecordedAt:         time.Unix(1700000000, 0),
+		MemoryUsedBytes:    &used,
+		MemoryFreeBytes:    &free,
+		MemoryUsagePercent: &memPercent,
+		CPUUsagePercent:    &busy,
+		CPUUserPercent:     &user,
+		CPUIdlePercent:     &idle,
+		CPUPerCore: []protocol.CPUCoreUsage{
+			{Core: 0, UsagePercent: 50, UserPercent: 50, IdlePercent: 50},
+			{Core: 1, UsagePercent: 25, UserPercent: 25, IdlePercent: 75},
+		},
+		Processes: []protocol.Process{
+			{PID: 42, Name: "nginx", User: "www-data", CPUPercent: 150, MemoryBytes: 1 << 20},
+		},
+	}
+}
+
+func TestSinkExportsMetrics(t *testing.T) {
+	c := &collector{}
+	sink := newTestSink(t, c)
+
+	if err := sink.SendMetrics(context.Background(), testPayload()); err != nil {
+		t.Fatalf("SendMetrics: %v", err)
+	}
+
+	if got := c.header.Get("Content-Type"); got != "application/x-protobuf" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := c.header.Get("X-Tenant"); got != "ops" {
+		t.Errorf("configured header = %q, want ops", got)
+	}
+
+	usage := c.find("system.memory.usage")
+	if len(usage) != 2 {
+		t.Fatalf("system.memory.usage has %d points, want 2", len(usage))
+	}
+	states := map[interface{}]float64{}
+	for _, pt := range usage {
+		states[pt.attrs["system.memory.state"]] = pt.value
+		if pt.unit != "By" {
+			t.Errorf("unit = %q, want By", pt.unit)
+		}
+		if pt.resource["host.name"] != "web-1" || pt.resource["service.instance.id"] != "agent-1" {
+			t.Errorf("resource = %v", pt.resource)
+		}
+	}
+	if states["used"] != 3<<30 || states["free"] != 1<<30 {
+		t.Errorf("memory states = %v", states)
+	}
+
+	if util := c.find("system.memory.utilization"); len(util) != 1 || util[0].value != 0.75 {
+		t.Errorf("system.memory.utilization = %+v, want one point of 0.75", util)
+	}
+
+	proc := c.find("process.cpu.utilization")
+	if len(proc) != 1 {
+		t.Fatalf("process.cpu.utilization has %d points, want 1", len(proc))
+	}
+	if proc[0].value != 1.5 {
+		t.Errorf("process.cpu.utilization = %v, want 1.5", proc[0].value)
+	}
+	if proc[0].attrs["process.pid"] != int64(42) || proc[0].attrs["process.executable.name"] != "nginx" {
+		t.Errorf("process attributes = %v", proc[0].attrs)
+	}
+
+	// system.cpu.utilization only has per-CPU points; the totals across
+	// all CPUs have metrics of their own
+	util := c.find("system.cpu.utilization")
+	if len(util) != 16 {
+		t.Errorf("system.cpu.utilization has %d points, want 8 modes for 2 CPUs", len(util))
+	}
+	perCore := map[int64]float64{}
+	for _, pt := range util {
+		core, ok := pt.attrs["cpu.logical_number"].(int64)
+		if !ok || pt.attrs["cpu.mode"] == nil {
+			t.Fatalf("system.cpu.utilization point without CPU and mode: %v", pt.attrs)
+		}
+		perCore[core] += pt.value
+	}
+	if perCore[0] != 1 || perCore[1] != 1 {
+		t.Errorf("modes of each CPU add up to %v, want 1", perCore)
+	}
+	if total := c.find("pingxeno.cpu.utilization"); len(total) != 1 || total[0].value != 0.4 || len(total[0].attrs) != 0 {
+		t.Errorf("pingxeno.cpu.utilization = %+v, want one point of 0.4", total)
+	}
+	modes := map[interface{}]float64{}
+	for _, pt := range c.find("pingxeno.cpu.mode.utilization") {
+		modes[pt.attrs["cpu.mode"]] = pt.value
+	}
+	if modes["user"] != 0.3 || modes["idle"] != 0.6 {
+		t.Errorf("pingxeno.cpu.mode.utilization = %v", modes)
+	}
+
+	// Sections missing from the payload are not exported at all
+	if pts := c.find("system.cpu.load_average.1m"); len(pts) != 0 {
+		t.Errorf("missing section exported %d points", len(pts))
+	}
+}
@@ -0,0 +1,278 @@
+package prometheus
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Metric types
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+)
+
+// family is a metric with all of its samples
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	labels []label
+	value  float64
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+// families converts a payload into metric families. Sections missing from
+// the payload are left out.
+func families(p *protocol.MetricsPayload) []*family {
+	var fams []*family
+	gauge := func(name, help string, value interface{}) {
+		if v, ok := number(value); ok {
+			fams = append(fams, &family{name: name, help: help, typ: typeGauge, samples: []sample{{value: v}}})
+		}
+	}
+
+	fams = append(fams, &family{
+		name: "pingxeno_agent_info",
+		help: "Identity of the host the agent runs on.",
+		typ:  typeGauge,
+		samples: []sample{{
+			labels: []label{
+				{"hostname", p.Hostname},
+				{"os_type", p.OSType},
+				{"os_version", p.OSVersion},
+				{"agent_id", p.AgentID},
+				{"machine_id", p.MachineID},
+			},
+			value: 1,
+		}},
+	})
+	fams = append(fams, &family{
+		name:    "pingxeno_collection_timestamp_seconds",
+		help:    "Unix time at which the metrics were collected.",
+		typ:     typeGauge,
+		samples: []sample{{value: float64(p.RecordedAt.UnixNano()) / 1e9}},
+	})
+
+	gauge("pingxeno_cpu_usage_percent", "CPU utilisation across all cores.", p.CPUUsagePercent)
+	gauge("pingxeno_cpu_cores", "Number of logical CPU cores.", p.CPUCores)
+	gauge("pingxeno_load1", "1-minute load average.", p.CPULoad1Min)
+	gauge("pingxeno_load5", "5-minute load average.", p.CPULoad5Min)
+	gauge("pingxeno_load15", "15-minute load average.", p.CPULoad15Min)
+
+	modes := &family{name: "pingxeno_cpu_mode_percent", help: "Share of CPU time by state since the previous collection; guest time is also counted in user and nice.", typ: typeGauge}
+	for _, m := range []struct {
+		mode  string
+		value *float64
+	}{
+		{"user", p.CPUUserPercent},
+		{"system", p.CPUSystemPercent},
+		{"nice", p.CPUNicePercent},
+		{"idle", p.CPUIdlePercent},
+		{"iowait", p.CPUIowaitPercent},
+		{"irq", p.CPUIrqPercent},
+		{"softirq", p.CPUSoftirqPercent},
+		{"steal", p.CPUStealPercent},
+		{"guest", p.CPUGuestPercent},
+	} {
+		if m.value != nil {
+			modes.samples = append(modes.samples, sample{[]label{{"mode", m.mode}}, *m.value})
+		}
+	}
+	if len(modes.samples) > 0 {
+		fams = append(fams, modes)
+	}
+
+	if len(p.CPUPerCore) > 0 {
+		usage := &family{name: "pingxeno_cpu_core_usage_percent", help: "CPU utilisation of a logical CPU.", typ: typeGauge}
+		coreModes := &family{name: "pingxeno_cpu_core_mode_percent", help: "Share of a logical CPU's time by state; guest time is also counted in user and nice.", typ: typeGauge}
+		for _, c := range p.CPUPerCore {
+			core := strconv.Itoa(c.Core)
+			usage.samples = append(usage.samples, sample{[]label{{"cpu", core}}, c.UsagePercent})
+			for _, m := range []struct {
+				mode  string
+				value float64
+			}{
+				{"user", c.UserPercent},
+				{"system", c.SystemPercent},
+				{"nice", c.NicePercent},
+				{"idle", c.IdlePercent},
+				{"iowait", c.IowaitPercent},
+				{"irq", c.IrqPercent},
+				{"softirq", c.SoftirqPercent},
+				{"steal", c.StealPercent},
+				{"guest", c.GuestPercent},
+			} {
+				coreModes.samples = append(coreModes.samples, sample{[]label{{"cpu", core}, {"mode", m.mode}}, m.value})
+			}
+		}
+		fams = append(fams, usage, coreModes)
+	}
+
+	gauge("pingxeno_memory_total_bytes", "Total physical memory.", p.MemoryTotalBytes)
+	gauge("pingxeno_memory_used_bytes", "Physical memory in use.", p.MemoryUsedBytes)
+	gauge("pingxeno_memory_free_bytes", "Free physical memory.", p.MemoryFreeBytes)
+	gauge("pingxeno_memory_usage_percent", "Physical memory utilisation.", p.MemoryUsagePercent)
+	gauge("pingxeno_swap_total_bytes", "Total swap space.", p.SwapTotalBytes)
+	gauge("pingxeno_swap_used_bytes", "Swap space in use.", p.SwapUsedBytes)
+	gauge("pingxeno_swap_free_bytes", "Free swap space.", p.SwapFreeBytes)
+	gauge("pingxeno_swap_usage_percent", "Swap utilisation.", p.SwapUsagePercent)
+
+	if len(p.DiskUsage) > 0 {
+		total := &family{name: "pingxeno_filesystem_size_bytes", help: "Filesystem size.", typ: typeGauge}
+		used := &family{name: "pingxeno_filesystem_used_bytes", help: "Filesystem space in use.", typ: typeGauge}
+		free := &family{name: "pingxeno_filesystem_free_bytes", help: "Free filesystem space.", typ: typeGauge}
+		usage := &family{name: "pingxeno_filesystem_usage_percent", help: "Filesystem utilisation.", typ: typeGauge}
+		for _, d := range p.DiskUsage {
+			labels := []label{{"device", d.Device}, {"mountpoint", d.MountPoint}, {"fstype", d.FSType}}
+			total.samples = append(total.samples, sample{labels, float64(d.TotalBytes)})
+			used.samples = append(used.samples, sample{labels, float64(d.UsedBytes)})
+			free.samples = append(free.samples, sample{labels, float64(d.FreeBytes)})
+			usage.samples = append(usage.samples, sample{labels, d.UsagePercent})
+		}
+		fams = append(fams, total, used, free, usage)
+	}
+
+	if len(p.NetworkInterfaces) > 0 {
+		counters := []struct {
+			name, help string
+			value      func(protocol.NetworkInterface) int64
+		}{
+			{"pingxeno_network_receive_bytes", "Bytes received.", func(n protocol.NetworkInterface) int64 { return n.BytesReceived }},
+			{"pingxeno_network_transmit_bytes", "Bytes sent.", func(n protocol.NetworkInterface) int64 { return n.BytesSent }},
+			{"pingxeno_network_receive_packets", "Packets received.", func(n protocol.NetworkInterface) int64 { return n.PacketsReceived }},
+			{"pingxeno_network_transmit_packets", "Packets sent.", func(n protocol.NetworkInterface) int64 { return n.PacketsSent }},
+			{"pingxeno_network_receive_errors", "Receive errors.", func(n protocol.NetworkInterface) int64 { return n.ErrorsIn }},
+			{"pingxeno_network_transmit_errors", "Transmit errors.", func(n protocol.NetworkInterface) int64 { return n.ErrorsOut }},
+			{"pingxeno_network_receive_drop", "Received packets dropped.", func(n protocol.NetworkInterface) int64 { return n.DropIn }},
+			{"pingxeno_network_transmit_drop", "Outgoing packets dropped.", func(n protocol.NetworkInterface) int64 { return n.DropOut }},
+		}
+		for _, c := range counters {
+			f := &family{name: c.name, help: c.help, typ: typeCounter}
+			for _, n := range p.NetworkInterfaces {
+				f.samples = append(f.samples, sample{[]label{{"interface", n.Name}}, float64(c.value(n))})
+			}
+			fams = append(fams, f)
+		}
+	}
+
+	if p.ProcessesTotal != nil {
+		states := &family{name: "pingxeno_processes", help: "Number of processes by state.", typ: typeGauge}
+		states.samples = append(states.samples, sample{[]label{{"state", "all"}}, float64(*p.ProcessesTotal)})
+		if p.ProcessesRunning != nil {
+			states.samples = append(states.samples, sample{[]label{{"state", "running"}}, float64(*p.ProcessesRunning)})
+		}
+		if p.ProcessesSleeping != nil {
+			states.samples = append(states.samples, sample{[]label{{"state", "sleeping"}}, float64(*p.ProcessesSleeping)})
+		}
+		fams = append(fams, states)
+	}
+
+	if len(p.Processes) > 0 {
+		cpu := &family{name: "pingxeno_process_cpu_percent", help: "CPU utilisation of a process.", typ: typeGauge}
+		mem := &family{name: "pingxeno_process_memory_bytes", help: "Resident memory of a process.", typ: typeGauge}
+		memPct := &family{name: "pingxeno_process_memory_percent", help: "Share of physical memory used by a process.", typ: typeGauge}
+		for _, proc := range p.Processes {
+			labels := []label{{"pid", strconv.Itoa(proc.PID)}, {"name", proc.Name}, {"user", proc.User}}
+			cpu.samples = append(cpu.samples, sample{labels, proc.CPUPercent})
+			mem.samples = append(mem.samples, sample{labels, float64(proc.MemoryBytes)})
+			memPct.samples = append(memPct.samples, sample{labels, proc.MemoryPercent})
+		}
+		fams = append(fams, cpu, mem, memPct)
+	}
+
+	gauge("pingxeno_uptime_seconds", "Time since the host booted.", p.UptimeSeconds)
+
+	return fams
+}
+
+// number dereferences the optional payload fields
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case *float64:
+		if v != nil {
+			return *v, true
+		}
+	case *int64:
+		if v != nil {
+			return float64(*v), true
+		}
+	case *int:
+		if v != nil {
+			return float64(*v), true
+		}
+	}
+	return 0, false
+}
+
+// write renders families in the Prometheus text format, or OpenMetrics if
+// openMetrics is set. The two differ in how counters are named and in the
+// terminating "# EOF" line.
+func write(w io.Writer, fams []*family, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+
+	for _, f := range fams {
+		sampleName := f.name
+		if f.typ == typeCounter {
+			sampleName += "_total"
+			if !openMetrics {
+				// The text format declares counters by their sample name
+				f = &family{name: sampleName, help: f.help, typ: f.typ, samples: f.samples}
+			}
+		}
+
+		bw.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, s := range f.samples {
+			bw.WriteString(sampleName)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.WriteString(l.name + `="` + escapeLabel(l.value) + `"`)
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteString(" " + formatValue(s.value) + "\n")
+		}
+	}
+
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
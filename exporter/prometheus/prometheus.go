@@ -0,0 +1,141 @@
+// Package prometheus serves the agent's metrics on a local HTTP endpoint in
+// the Prometheus text or OpenMetrics format, so Prometheus can scrape the
+// agent directly.
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+// Modes for where scraped metrics come from
+const (
+	ModeCache  = "cache"  // Serve the payload from the latest collection
+	ModeScrape = "scrape" // Collect fresh metrics on every scrape
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// CollectFunc gathers a fresh payload
+type CollectFunc func(ctx context.Context) (*protocol.MetricsPayload, error)
+
+// Exporter serves the latest payload to Prometheus
+type Exporter struct {
+	config  config.PrometheusConfig
+	collect CollectFunc
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	latest *protocol.MetricsPayload
+}
+
+// NewExporter creates an exporter. collect is only used in scrape mode.
+func NewExporter(cfg config.PrometheusConfig, collect CollectFunc, logger *zap.Logger) *Exporter {
+	return &Exporter{
+		config:  cfg,
+		collect: collect,
+		logger:  logger,
+	}
+}
+
+// Update stores the payload served in cache mode
+func (e *Exporter) Update(payload *protocol.MetricsPayload) {
+	e.mu.Lock()
+	e.latest = payload
+	e.mu.Unlock()
+}
+
+// Serve listens on the configured address until ctx is cancelled
+func (e *Exporter) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", e.config.Listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(e.config.Path, e)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	e.logger.Info("Serving Prometheus metrics",
+		zap.String("address", listener.Addr().String()),
+		zap.String("path", e.config.Path),
+		zap.String("mode", e.config.Mode),
+	)
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP renders the metrics, negotiating OpenMetrics from the Accept header
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := e.payload(r.Context())
+	if err != nil {
+		e.logger.Warn("Failed to collect metrics for scrape", zap.Error(err))
+		http.Error(w, "failed to collect metrics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if payload == nil {
+		http.Error(w, "no metrics collected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	var buf bytes.Buffer
+	if err := write(&buf, families(payload), openMetrics); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypeText)
+	}
+	w.Write(buf.Bytes())
+}
+
+// payload returns the payload to serve for a scrape
+func (e *Exporter) payload(ctx context.Context) (*protocol.MetricsPayload, error) {
+	if e.config.Mode == ModeScrape {
+		// Scrapes are serialised so overlapping ones do not collect twice
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		payload, err := e.collect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.latest = payload
+		return payload, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.latest, nil
+}
@@ -0,0 +1,191 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers and enum values from prometheus/prompb
+const (
+	fieldWriteTimeseries = 1
+	fieldWriteMetadata   = 3
+
+	fieldSeriesLabels  = 1
+	fieldSeriesSamples = 2
+
+	fieldLabelName  = 1
+	fieldLabelValue = 2
+
+	fieldSampleValue     = 1
+	fieldSampleTimestamp = 2
+
+	fieldMetadataType   = 1
+	fieldMetadataFamily = 2
+	fieldMetadataHelp   = 4
+
+	metadataCounter = 1
+	metadataGauge   = 2
+)
+
+// RemoteWriteSink sends payloads as snappy-compressed remote_write
+// WriteRequests. It implements sender.Sink, so it gets the same queueing
+// and retries as the API output. Series use the same names as the scrape
+// endpoint, with host and agent_id labels in place of the target labels
+// Prometheus would add to a scrape.
+type RemoteWriteSink struct {
+	config config.RemoteWriteConfig
+	poster *sender.Poster
+	logger *zap.Logger
+}
+
+// NewRemoteWriteSink creates a remote_write sink posting through poster,
+// which must not compress on its own
+func NewRemoteWriteSink(cfg config.RemoteWriteConfig, poster *sender.Poster, logger *zap.Logger) *RemoteWriteSink {
+	return &RemoteWriteSink{
+		config: cfg,
+		poster: poster,
+		logger: logger,
+	}
+}
+
+// SendMetrics writes a single payload
+func (s *RemoteWriteSink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	_, err := s.SendBatch(ctx, []*protocol.MetricsPayload{payload})
+	return err
+}
+
+// SendBatch writes several payloads in one request. The receiver accepts
+// or rejects a request as a whole, so there are no per-item errors.
+func (s *RemoteWriteSink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case s.config.BearerToken != "":
+		header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	case s.config.Username != "":
+		credentials := s.config.Username + ":" + s.config.Password
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	body := snappy.Encode(nil, s.encode(payloads))
+	if _, err := s.poster.Post(ctx, s.config.URL, body, header); err != nil {
+		return nil, err
+	}
+	return make([]error, len(payloads)), nil
+}
+
+// Close releases idle connections
+func (s *RemoteWriteSink) Close() error {
+	return s.poster.Close()
+}
+
+// encode builds a WriteRequest with one time series per sample and the
+// type and help of every family as metadata
+func (s *RemoteWriteSink) encode(payloads []*protocol.MetricsPayload) []byte {
+	var req []byte
+	metadata := make(map[string]*family)
+
+	for _, p := range payloads {
+		extra := []label{{"host", p.Hostname}, {"agent_id", p.AgentID}}
+		for name, value := range s.config.Labels {
+			extra = append(extra, label{name, value})
+		}
+		timestamp := p.RecordedAt.UnixMilli()
+
+		for _, f := range families(p) {
+			name := f.name
+			if f.typ == typeCounter {
+				name += "_total"
+			}
+			metadata[name] = f
+
+			for _, smp := range f.samples {
+				req = appendMessage(req, fieldWriteTimeseries, encodeSeries(name, smp, extra, timestamp))
+			}
+		}
+	}
+
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := metadata[name]
+		typ := uint64(metadataGauge)
+		if f.typ == typeCounter {
+			typ = metadataCounter
+		}
+
+		var md []byte
+		md = protowire.AppendTag(md, fieldMetadataType, protowire.VarintType)
+		md = protowire.AppendVarint(md, typ)
+		md = appendString(md, fieldMetadataFamily, name)
+		md = appendString(md, fieldMetadataHelp, f.help)
+		req = appendMessage(req, fieldWriteMetadata, md)
+	}
+
+	return req
+}
+
+// encodeSeries encodes a TimeSeries with a single sample. Labels must be
+// sorted by name and may not have empty values.
+func encodeSeries(name string, smp sample, extra []label, timestamp int64) []byte {
+	labels := []label{{"__name__", name}}
+	for _, set := range [][]label{smp.labels, extra} {
+		for _, l := range set {
+			if l.value != "" && !hasLabel(labels, l.name) {
+				labels = append(labels, l)
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	var series []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = appendString(lb, fieldLabelName, l.name)
+		lb = appendString(lb, fieldLabelValue, l.value)
+		series = appendMessage(series, fieldSeriesLabels, lb)
+	}
+
+	var sm []byte
+	sm = protowire.AppendTag(sm, fieldSampleValue, protowire.Fixed64Type)
+	sm = protowire.AppendFixed64(sm, math.Float64bits(smp.value))
+	sm = protowire.AppendTag(sm, fieldSampleTimestamp, protowire.VarintType)
+	sm = protowire.AppendVarint(sm, uint64(timestamp))
+	return appendMessage(series, fieldSeriesSamples, sm)
+}
+
+// hasLabel reports whether a label is already set, so sample labels take
+// precedence over the identity and configured labels
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
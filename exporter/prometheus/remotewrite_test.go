@@ -0,0 +1,250 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// series is a decoded TimeSeries with its single sample
+type series struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+func (s series) get(name string) string {
+	for _, l := range s.labels {
+		if l.name == name {
+			return l.value
+		}
+	}
+	return ""
+}
+
+// receiver is a stub remote_write endpoint that decodes every WriteRequest
+// it is sent. The field numbers are spelled out from prompb rather than
+// taken from remotewrite.go.
+type receiver struct {
+	mu       sync.Mutex
+	header   http.Header
+	series   []series
+	metadata map[string]uint64 // Family name to MetricType
+	errors   []string
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.header = r.Header.Clone()
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		rc.errors = append(rc.errors, "snappy: "+err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if rc.metadata == nil {
+		rc.metadata = make(map[string]uint64)
+	}
+	walk(body, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+		switch num {
+		case 1: // WriteRequest.timeseries
+			rc.series = append(rc.series, decodeSeries(value))
+		case 3: // WriteRequest.metadata: type = 1, metric_family_name = 2
+			var name string
+			var mtype uint64
+			walk(value, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+				switch num {
+				case 1:
+					mtype = varint
+				case 2:
+					name = string(value)
+				}
+			})
+			rc.metadata[name] = mtype
+		}
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeSeries reads a TimeSeries: labels = 1 (name = 1, value = 2) and
+// samples = 2 (value = 1, timestamp = 2)
+func decodeSeries(b []byte) series {
+	var s series
+	walk(b, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+		switch num {
+		case 1:
+			var l label
+			walk(value, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+				switch num {
+				case 1:
+					l.name = string(value)
+				case 2:
+					l.value = string(value)
+				}
+			})
+			s.labels = append(s.labels, l)
+		case 2:
+			walk(value, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) {
+				switch num {
+				case 1:
+					s.value = math.Float64frombits(varint)
+				case 2:
+					s.timestamp = int64(varint)
+				}
+			})
+		}
+	})
+	return s
+}
+
+// walk calls fn with every field of a message. Varint and fixed64 values
+// are passed in varint.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+
+		var value []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			varint, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		fn(num, typ, value, varint)
+	}
+}
+
+// find returns the series with the given metric name
+func (rc *receiver) find(name string) []series {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var out []series
+	for _, s := range rc.series {
+		if s.get("__name__") == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func newTestRemoteWrite(t *testing.T, rc *receiver) *RemoteWriteSink {
+	t.Helper()
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+
+	poster, err := sender.NewPoster(config.DefaultConfig(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { poster.Close() })
+
+	cfg := config.RemoteWriteConfig{
+		URL:      srv.URL + "/api/v1/write",
+		Username: "agent",
+		Password: "secret",
+		Labels:   map[string]string{"env": "prod"},
+	}
+	return NewRemoteWriteSink(cfg, poster, zap.NewNop())
+}
+
+func testPayload() *protocol.MetricsPayload {
+	used := int64(3 << 30)
+	return &protocol.MetricsPayload{
+		AgentID:         "agent-1",
+		Hostname:        "web-1",
+		RecordedAt:      time.UnixMilli(1700000000123),
+		MemoryUsedBytes: &used,
+		NetworkInterfaces: []protocol.NetworkInterface{
+			{Name: "eth0", BytesReceived: 1000},
+		},
+	}
+}
+
+func TestRemoteWriteSendsSeries(t *testing.T) {
+	rc := &receiver{}
+	sink := newTestRemoteWrite(t, rc)
+
+	if err := sink.SendMetrics(context.Background(), testPayload()); err != nil {
+		t.Fatalf("SendMetrics: %v", err)
+	}
+	if len(rc.errors) > 0 {
+		t.Fatalf("receiver errors: %v", rc.errors)
+	}
+
+	for name, want := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := rc.header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if user, pass, ok := (&http.Request{Header: rc.header}).BasicAuth(); !ok || user != "agent" || pass != "secret" {
+		t.Errorf("basic auth = %q, %q, %v", user, pass, ok)
+	}
+
+	mem := rc.find("pingxeno_memory_used_bytes")
+	if len(mem) != 1 {
+		t.Fatalf("pingxeno_memory_used_bytes has %d series, want 1", len(mem))
+	}
+	s := mem[0]
+	if s.value != 3<<30 || s.timestamp != 1700000000123 {
+		t.Errorf("sample = %v at %d", s.value, s.timestamp)
+	}
+	if s.get("host") != "web-1" || s.get("agent_id") != "agent-1" || s.get("env") != "prod" {
+		t.Errorf("labels = %v", s.labels)
+	}
+	if !sort.SliceIsSorted(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name }) {
+		t.Errorf("labels are not sorted by name: %v", s.labels)
+	}
+
+	// Counters get the _total suffix, like the scrape endpoint
+	rx := rc.find("pingxeno_network_receive_bytes_total")
+	if len(rx) != 1 || rx[0].get("interface") != "eth0" || rx[0].value != 1000 {
+		t.Errorf("pingxeno_network_receive_bytes_total = %+v", rx)
+	}
+
+	// MetricType: COUNTER = 1, GAUGE = 2
+	if got := rc.metadata["pingxeno_network_receive_bytes_total"]; got != 1 {
+		t.Errorf("counter metadata type = %d, want 1", got)
+	}
+	if got := rc.metadata["pingxeno_memory_used_bytes"]; got != 2 {
+		t.Errorf("gauge metadata type = %d, want 2", got)
+	}
+}
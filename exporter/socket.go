@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+// maxDatagram keeps UDP packets within a typical path MTU
+const maxDatagram = 1432
+
+// SocketSink writes encoded payloads to a TCP or UDP socket, as expected by
+// Graphite and StatsD. It implements sender.Sink. TCP connections are kept
+// open and redialled after an error.
+type SocketSink struct {
+	config  config.SocketConfig
+	encoder Encoder
+	timeout time.Duration
+	logger  *zap.Logger
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSocketSink creates a sink that encodes payloads with encoder. timeout
+// bounds dialling and each write.
+func NewSocketSink(cfg config.SocketConfig, encoder Encoder, timeout time.Duration, logger *zap.Logger) *SocketSink {
+	return &SocketSink{
+		config:  cfg,
+		encoder: encoder,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// SendMetrics writes a single payload
+func (s *SocketSink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	_, err := s.SendBatch(ctx, []*protocol.MetricsPayload{payload})
+	return err
+}
+
+// SendBatch writes several payloads. Socket protocols have no
+// acknowledgements, so there are no per-item errors.
+func (s *SocketSink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	var data []byte
+	for _, payload := range payloads {
+		data = s.encoder.Encode(data, payload)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		dialer := net.Dialer{Timeout: s.timeout}
+		conn, err := dialer.DialContext(ctx, s.config.Network, s.config.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", s.config.Address, err)
+		}
+		s.conn = conn
+	}
+
+	if err := s.write(data); err != nil {
+		// Redial on the next attempt; lines written before the error may be
+		// sent twice, which the receivers treat as an update of the same value
+		s.conn.Close()
+		s.conn = nil
+		return nil, fmt.Errorf("failed to write to %s: %w", s.config.Address, err)
+	}
+
+	return make([]error, len(payloads)), nil
+}
+
+// write sends data, splitting it at line boundaries into datagrams for UDP
+func (s *SocketSink) write(data []byte) error {
+	if s.timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+
+	if s.config.Network != "udp" {
+		_, err := s.conn.Write(data)
+		return err
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxDatagram {
+			n = bytes.LastIndexByte(data[:maxDatagram], '\n') + 1
+			if n == 0 {
+				// A single line longer than a datagram is sent on its own
+				n = bytes.IndexByte(data, '\n') + 1
+				if n == 0 {
+					n = len(data)
+				}
+			}
+		}
+		if _, err := s.conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Close closes the connection
+func (s *SocketSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,65 @@
+// Package statsd encodes metrics as StatsD gauges.
+package statsd
+
+import (
+	"strings"
+
+	"github.com/pingxeno/agent/exporter"
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Encoder writes every field as a gauge, with the identity and point tags
+// in the DogStatsD tag extension:
+//
+//	pingxeno.disk.used_bytes:123|g|#host:web1,agent_id:abc,mountpoint:/
+//
+// Network and process counters are sent as gauges of their running totals
+// rather than StatsD counters, since StatsD counters are increments.
+type Encoder struct {
+	Prefix string
+}
+
+// Encode implements exporter.Encoder
+func (e Encoder) Encode(dst []byte, p *protocol.MetricsPayload) []byte {
+	identity := exporter.IdentityTags(p)
+
+	for _, point := range exporter.Points(p) {
+		for _, field := range point.Fields {
+			if e.Prefix != "" {
+				dst = append(dst, nameSanitizer.Replace(e.Prefix)...)
+				dst = append(dst, '.')
+			}
+			dst = append(dst, nameSanitizer.Replace(point.Measurement)...)
+			dst = append(dst, '.')
+			dst = append(dst, nameSanitizer.Replace(field.Name)...)
+			dst = append(dst, ':')
+			dst = append(dst, exporter.FormatValue(field)...)
+			dst = append(dst, "|g"...)
+
+			first := true
+			for _, tags := range [][]exporter.Tag{identity, point.Tags} {
+				for _, tag := range tags {
+					if tag.Value == "" {
+						continue
+					}
+					if first {
+						dst = append(dst, "|#"...)
+						first = false
+					} else {
+						dst = append(dst, ',')
+					}
+					dst = append(dst, tagSanitizer.Replace(tag.Key)...)
+					dst = append(dst, ':')
+					dst = append(dst, tagSanitizer.Replace(tag.Value)...)
+				}
+			}
+			dst = append(dst, '\n')
+		}
+	}
+	return dst
+}
+
+var (
+	nameSanitizer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", " ", "_", "\n", "_")
+	tagSanitizer  = strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_", "\n", "_")
+)
@@ -3,10 +3,14 @@ module github.com/pingxeno/agent
 go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.17.4
 	github.com/shirou/gopsutil v2.21.11+incompatible
 	github.com/spf13/cobra v1.8.0
 	github.com/spf13/viper v1.18.2
 	go.uber.org/zap v1.26.0
+	golang.org/x/net v0.19.0
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
@@ -1,30 +1,55 @@
 package logger
 
 import (
+	"fmt"
 	"os"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-// NewLogger creates a new logger instance
-func NewLogger(level string, logFile string) (*zap.Logger, error) {
-	var zapLevel zapcore.Level
-	switch level {
+// level is shared by every logger so that it can be changed at runtime
+var level = zap.NewAtomicLevel()
+
+// parseLevel maps a configured level name to a zap level
+func parseLevel(name string) (zapcore.Level, bool) {
+	switch name {
 	case "debug":
-		zapLevel = zapcore.DebugLevel
+		return zapcore.DebugLevel, true
 	case "info":
-		zapLevel = zapcore.InfoLevel
+		return zapcore.InfoLevel, true
 	case "warn":
-		zapLevel = zapcore.WarnLevel
+		return zapcore.WarnLevel, true
 	case "error":
-		zapLevel = zapcore.ErrorLevel
+		return zapcore.ErrorLevel, true
 	default:
-		zapLevel = zapcore.InfoLevel
+		return zapcore.InfoLevel, false
+	}
+}
+
+// ValidLevel reports whether name is a supported log level
+func ValidLevel(name string) bool {
+	_, ok := parseLevel(name)
+	return ok
+}
+
+// SetLevel changes the level of every logger created by NewLogger
+func SetLevel(name string) error {
+	zapLevel, ok := parseLevel(name)
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
 	}
+	level.SetLevel(zapLevel)
+	return nil
+}
+
+// NewLogger creates a new logger instance
+func NewLogger(levelName string, logFile string) (*zap.Logger, error) {
+	zapLevel, _ := parseLevel(levelName)
+	level.SetLevel(zapLevel)
 
 	config := zap.NewProductionConfig()
-	config.Level = zap.NewAtomicLevelAt(zapLevel)
+	config.Level = level
 	config.EncoderConfig.TimeKey = "timestamp"
 	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
@@ -42,7 +67,7 @@ func NewLogger(level string, logFile string) (*zap.Logger, error) {
 	core := zapcore.NewCore(
 		zapcore.NewJSONEncoder(config.EncoderConfig),
 		writeSyncer,
-		zapLevel,
+		level,
 	)
 
 	return zap.New(core), nil
@@ -1,23 +1,49 @@
 package logger
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const maxLogSize = 10 * 1024 * 1024 // 10MB
 
+// rotatedSuffix is the timestamp appended to rotated files
+const rotatedSuffix = "20060102-150405"
+
+// RotateOptions controls when a RotatingWriter rotates and which rotated
+// files it keeps
+type RotateOptions struct {
+	MaxSize  int64         // Rotate once the file reaches this size (default 10MB)
+	MaxFiles int           // Keep at most this many rotated files (0 keeps all)
+	MaxAge   time.Duration // Remove rotated files older than this (0 keeps all)
+}
+
 // RotatingWriter wraps a file with automatic rotation
 type RotatingWriter struct {
 	filename string
+	opts     RotateOptions
 	file     *os.File
 	mu       sync.Mutex
 }
 
 // NewRotatingWriter creates a new rotating file writer
 func NewRotatingWriter(filename string) (*RotatingWriter, error) {
+	return NewRotatingWriterWithOptions(filename, RotateOptions{})
+}
+
+// NewRotatingWriterWithOptions creates a rotating file writer with a custom
+// size limit and retention
+func NewRotatingWriterWithOptions(filename string, opts RotateOptions) (*RotatingWriter, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = maxLogSize
+	}
+
 	// Ensure directory exists
 	dir := filepath.Dir(filename)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -32,11 +58,12 @@ func NewRotatingWriter(filename string) (*RotatingWriter, error) {
 
 	return &RotatingWriter{
 		filename: filename,
+		opts:     opts,
 		file:     file,
 	}, nil
 }
 
-// Write implements io.Writer
+// Write implements io.Writer. A single write is never split across files.
 func (rw *RotatingWriter) Write(p []byte) (n int, err error) {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
@@ -48,7 +75,7 @@ func (rw *RotatingWriter) Write(p []byte) (n int, err error) {
 	}
 
 	// If file exceeds max size, rotate it
-	if info.Size() >= maxLogSize {
+	if info.Size() >= rw.opts.MaxSize {
 		if err := rw.rotate(); err != nil {
 			return 0, err
 		}
@@ -71,8 +98,15 @@ func (rw *RotatingWriter) rotate() error {
 		return err
 	}
 
-	// Rename old file with timestamp
-	oldFilename := rw.filename + "." + time.Now().Format("20060102-150405")
+	// Rename old file with timestamp, without overwriting a file rotated
+	// earlier in the same second
+	oldFilename := rw.filename + "." + time.Now().Format(rotatedSuffix)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(oldFilename); os.IsNotExist(err) {
+			break
+		}
+		oldFilename = fmt.Sprintf("%s.%s-%d", rw.filename, time.Now().Format(rotatedSuffix), i)
+	}
 	if err := os.Rename(rw.filename, oldFilename); err != nil {
 		// If rename fails, try to remove and create new
 		os.Remove(rw.filename)
@@ -85,9 +119,82 @@ func (rw *RotatingWriter) rotate() error {
 	}
 
 	rw.file = file
+	rw.prune()
 	return nil
 }
 
+// prune removes rotated files beyond MaxFiles or older than MaxAge
+func (rw *RotatingWriter) prune() {
+	if rw.opts.MaxFiles <= 0 && rw.opts.MaxAge <= 0 {
+		return
+	}
+
+	files, err := RotatedFiles(rw.filename)
+	if err != nil {
+		return
+	}
+
+	for i, name := range files {
+		remove := rw.opts.MaxFiles > 0 && len(files)-i > rw.opts.MaxFiles
+		if !remove && rw.opts.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > rw.opts.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(name)
+		}
+	}
+}
+
+// RotatedFiles returns the files rotated from filename, oldest first
+func RotatedFiles(filename string) ([]string, error) {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	type rotated struct {
+		name string
+		at   time.Time
+		seq  int
+	}
+	var files []rotated
+	for _, name := range matches {
+		suffix := name[len(filename)+1:]
+		if len(suffix) < len(rotatedSuffix) {
+			continue
+		}
+		at, err := time.Parse(rotatedSuffix, suffix[:len(rotatedSuffix)])
+		if err != nil {
+			continue
+		}
+		seq := 0
+		if rest := suffix[len(rotatedSuffix):]; rest != "" {
+			if !strings.HasPrefix(rest, "-") {
+				continue
+			}
+			if seq, err = strconv.Atoi(rest[1:]); err != nil {
+				continue
+			}
+		}
+		files = append(files, rotated{name: name, at: at, seq: seq})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].at.Equal(files[j].at) {
+			return files[i].at.Before(files[j].at)
+		}
+		return files[i].seq < files[j].seq
+	})
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.name
+	}
+	return names, nil
+}
+
 // Close closes the file
 func (rw *RotatingWriter) Close() error {
 	rw.mu.Lock()
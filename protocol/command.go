@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Built-in command actions
+const (
+	ActionCollectNow      = "collect_now"
+	ActionSendDiagnostics = "send_diagnostics"
+	ActionRestart         = "restart"
+	ActionTopProcesses    = "top_processes"
+)
+
+// Command result statuses
+const (
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandRejected  = "rejected" // Not run: bad signature, expired, replayed or not allowed
+)
+
+// CommandPoll asks the API for pending commands. The API may hold the
+// request open for up to Wait before answering with an empty list.
+type CommandPoll struct {
+	AgentID string `json:"agent_id"`
+	Wait    string `json:"wait,omitempty"`
+}
+
+// CommandPollResponse lists the commands pending for the agent
+type CommandPollResponse struct {
+	Commands []SignedCommand `json:"commands"`
+}
+
+// SignedCommand carries a command with the base64 Ed25519 signature of its
+// exact JSON encoding
+type SignedCommand struct {
+	Command   json.RawMessage `json:"command"`
+	Signature string          `json:"signature"`
+}
+
+// Command is an action the API asks one agent to run
+type Command struct {
+	ID        string          `json:"id"`
+	AgentID   string          `json:"agent_id"`
+	Action    string          `json:"action"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	IssuedAt  time.Time       `json:"issued_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// CommandResult reports the outcome of a command to the API
+type CommandResult struct {
+	ID         string      `json:"id"`
+	Action     string      `json:"action"`
+	Status     string      `json:"status"`
+	Output     interface{} `json:"output,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "time"
+
+// EnrollRequest exchanges a one-time enrollment token for per-agent
+// credentials. The identifiers let the API bind the credentials to the
+// machine the token was used on.
+type EnrollRequest struct {
+	Token      string `json:"token"`
+	AgentID    string `json:"agent_id"`
+	MachineID  string `json:"machine_id,omitempty"`
+	SystemUUID string `json:"system_uuid,omitempty"`
+	Hostname   string `json:"hostname"`
+	OSType     string `json:"os_type"`
+	OSVersion  string `json:"os_version"`
+}
+
+// RotateRequest asks for new credentials before the current ones expire.
+// It is authenticated with the current API key.
+type RotateRequest struct {
+	AgentID string `json:"agent_id"`
+}
+
+// CredentialsResponse carries credentials issued by the API. A zero
+// ExpiresAt means they do not expire.
+type CredentialsResponse struct {
+	APIKey    string    `json:"api_key"`
+	ServerKey string    `json:"server_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -43,6 +43,44 @@ type MetricsPayload struct {
 	DiskUUID             string                 `json:"disk_uuid,omitempty"`
 	AgentID              string                 `json:"agent_id,omitempty"`
 	RecordedAt           time.Time              `json:"recorded_at"`
+
+	// CPU time by state since the previous collection, in percent; guest
+	// time is also included in user and nice time
+	CPUUserPercent    *float64       `json:"cpu_user_percent,omitempty"`
+	CPUSystemPercent  *float64       `json:"cpu_system_percent,omitempty"`
+	CPUNicePercent    *float64       `json:"cpu_nice_percent,omitempty"`
+	CPUIdlePercent    *float64       `json:"cpu_idle_percent,omitempty"`
+	CPUIowaitPercent  *float64       `json:"cpu_iowait_percent,omitempty"`
+	CPUIrqPercent     *float64       `json:"cpu_irq_percent,omitempty"`
+	CPUSoftirqPercent *float64       `json:"cpu_softirq_percent,omitempty"`
+	CPUStealPercent   *float64       `json:"cpu_steal_percent,omitempty"`
+	CPUGuestPercent   *float64       `json:"cpu_guest_percent,omitempty"`
+	CPUPerCore        []CPUCoreUsage `json:"cpu_per_core,omitempty"`
+
+	// Remote configuration acknowledgement: the revision in effect when the
+	// payload was collected, and the last revision the agent refused
+	ConfigRevision int64            `json:"config_revision,omitempty"`
+	ConfigRejected *ConfigRejection `json:"config_rejected,omitempty"`
+
+	// Collectors that failed or timed out; their sections are missing
+	// because the values are unknown, not zero
+	CollectionErrors []CollectionError `json:"collection_errors,omitempty"`
+}
+
+// CPUCoreUsage is the usage of one logical CPU since the previous
+// collection, in percent
+type CPUCoreUsage struct {
+	Core           int     `json:"core"`
+	UsagePercent   float64 `json:"usage_percent"`
+	UserPercent    float64 `json:"user_percent"`
+	SystemPercent  float64 `json:"system_percent"`
+	NicePercent    float64 `json:"nice_percent"`
+	IdlePercent    float64 `json:"idle_percent"`
+	IowaitPercent  float64 `json:"iowait_percent"`
+	IrqPercent     float64 `json:"irq_percent"`
+	SoftirqPercent float64 `json:"softirq_percent"`
+	StealPercent   float64 `json:"steal_percent"`
+	GuestPercent   float64 `json:"guest_percent"`
 }
 
 // DiskPartition represents disk partition information
@@ -69,7 +107,9 @@ type NetworkInterface struct {
 	DropOut         int64  `json:"drop_out"`
 }
 
-// Process represents process information
+// Process represents process information. CPUPercent is the CPU time used
+// since the previous collection as a share of one core, so a busy
+// multi-threaded process can exceed 100.
 type Process struct {
 	PID         int     `json:"pid"`
 	Name        string  `json:"name"`
@@ -82,3 +122,31 @@ type Process struct {
 	CreatedAt   int64   `json:"created_at"`
 }
 
+// CollectionError reports a collector that produced no section
+type CollectionError struct {
+	Collector  string `json:"collector"`
+	Error      string `json:"error"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// MetricsResponse is the API response to a single submission
+type MetricsResponse struct {
+	ServerID interface{}   `json:"server_id"`
+	StatID   interface{}   `json:"stat_id"`
+	Config   *RemoteConfig `json:"config,omitempty"`
+}
+
+// BatchResponse is the API response to a batch submission
+type BatchResponse struct {
+	Results []BatchItemResult `json:"results"`
+	Config  *RemoteConfig     `json:"config,omitempty"`
+}
+
+// BatchItemResult reports whether one item of a batch was accepted
+type BatchItemResult struct {
+	Index     int    `json:"index"`
+	Accepted  bool   `json:"accepted"`
+	Error     string `json:"error,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+}
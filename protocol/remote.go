@@ -0,0 +1,25 @@
+package protocol
+
+// RemoteConfig is a configuration revision sent by the API with a
+// submission response. Unset fields fall back to the local configuration,
+// so every revision is complete on its own.
+type RemoteConfig struct {
+	Revision   int64         `json:"revision"`
+	Interval   string        `json:"interval,omitempty"`   // Collection interval, e.g. "30s"
+	Collectors []string      `json:"collectors,omitempty"` // Collectors to run
+	Filter     *RemoteFilter `json:"filter,omitempty"`     // Sections sent to the API
+	LogLevel   string        `json:"log_level,omitempty"`
+}
+
+// RemoteFilter selects the payload sections sent to the API
+type RemoteFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ConfigRejection reports a revision the agent did not apply, or rolled
+// back because it caused send failures
+type ConfigRejection struct {
+	Revision int64  `json:"revision"`
+	Error    string `json:"error"`
+}
@@ -0,0 +1,24 @@
+package protocol
+
+// Stream message types. The agent opens the connection with a hello; the
+// API answers with a welcome carrying the last sequence number it holds for
+// the session, and the agent resends everything after it. Metrics are
+// acknowledged by sequence number, cumulatively.
+const (
+	StreamHello   = "hello"   // Agent: opens a session or resumes it
+	StreamWelcome = "welcome" // API: Seq is the last message received in the session
+	StreamMetrics = "metrics" // Agent: one payload
+	StreamAck     = "ack"     // API: every message up to Seq was received
+	StreamViewers = "viewers" // API: Viewers is the number of attached viewers
+)
+
+// StreamMessage is one frame on the streaming connection
+type StreamMessage struct {
+	Type      string          `json:"type"`
+	Session   string          `json:"session,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	AgentID   string          `json:"agent_id,omitempty"`
+	ServerKey string          `json:"server_key,omitempty"`
+	Payload   *MetricsPayload `json:"payload,omitempty"`
+	Viewers   int             `json:"viewers,omitempty"`
+}
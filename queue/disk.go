@@ -0,0 +1,466 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+)
+
+// Disk is a persistent queue backed by append-only segment files.
+//
+// Each segment holds one JSON payload per line. A cursor file records the
+// read position in the oldest segment, so unsent payloads survive restarts.
+// Fully consumed segments are deleted, and when the size cap is exceeded
+// the oldest segment is dropped as a whole.
+type Disk struct {
+	dir    string
+	opts   Options
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	segments []segment // Oldest first; the last one is the write head
+	head     *os.File
+	cursor   position
+	pending  int
+	dropped  uint64
+	peeked   []position
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// position is a read offset within a segment. For peeked payloads, consumed
+// counts the records between the cursor and this position, including ones
+// skipped because they were corrupt or expired.
+type position struct {
+	seq      uint64
+	offset   int64
+	consumed int
+}
+
+// NewDisk opens (or creates) a disk queue in dir
+func NewDisk(dir string, opts Options, logger *zap.Logger) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &Disk{
+		dir:    dir,
+		opts:   opts.withDefaults(),
+		logger: logger,
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	// Always write to a fresh segment so a torn record from a crash is never
+	// followed by new data in the same file
+	if err := q.rotate(); err != nil {
+		return nil, err
+	}
+	// A cursor naming a segment that no longer exists, e.g. because the
+	// segment files were removed by hand, would skip every segment below it
+	if !q.hasSegment(q.cursor.seq) {
+		q.cursor = position{seq: q.segments[0].seq}
+	}
+
+	q.enforceLimits()
+
+	if q.pending > 0 {
+		logger.Info("Loaded queued payloads from disk",
+			zap.String("dir", dir),
+			zap.Int("pending", q.pending),
+		)
+	}
+
+	return q, nil
+}
+
+// load scans existing segments and restores the cursor
+func (q *Disk) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+
+	if data, err := os.ReadFile(filepath.Join(q.dir, cursorFile)); err == nil {
+		fmt.Sscanf(string(data), "%d %d", &q.cursor.seq, &q.cursor.offset)
+	}
+
+	// Remove segments that were consumed before the last shutdown
+	for len(q.segments) > 0 && q.segments[0].seq < q.cursor.seq {
+		os.Remove(q.segmentPath(q.segments[0].seq))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0].seq != q.cursor.seq {
+		q.cursor.offset = 0
+		if len(q.segments) > 0 {
+			q.cursor.seq = q.segments[0].seq
+		}
+	}
+
+	for _, seg := range q.segments {
+		n, err := q.countRecords(seg.seq, q.offsetIn(seg.seq))
+		if err != nil {
+			return err
+		}
+		q.pending += n
+	}
+
+	return nil
+}
+
+// Push appends a payload to the head segment and syncs it to disk
+func (q *Disk) Push(payload *protocol.MetricsPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	head := &q.segments[len(q.segments)-1]
+	if head.size > 0 && head.size+int64(len(data)) > q.opts.SegmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		head = &q.segments[len(q.segments)-1]
+	}
+
+	n, err := q.head.Write(data)
+	head.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write queue segment: %w", err)
+	}
+	if err := q.head.Sync(); err != nil {
+		return fmt.Errorf("failed to sync queue segment: %w", err)
+	}
+	q.pending++
+
+	q.enforceLimits()
+	return nil
+}
+
+// Peek returns up to n payloads from the head of the queue. Corrupt and
+// expired records are skipped and accounted as dropped once acknowledged.
+func (q *Disk) Peek(n int) ([]*protocol.MetricsPayload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.peeked = nil
+	now := time.Now()
+
+	var out []*protocol.MetricsPayload
+	last := q.cursor
+	consumed := 0
+
+	for _, seg := range q.segments {
+		if len(out) >= n {
+			break
+		}
+		if seg.seq < q.cursor.seq {
+			continue
+		}
+
+		offset := q.offsetIn(seg.seq)
+		f, err := os.Open(q.segmentPath(seg.seq))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open queue segment: %w", err)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to seek queue segment: %w", err)
+		}
+
+		r := bufio.NewReader(f)
+		for len(out) < n {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				// A trailing record without newline is a torn write; it is
+				// discarded along with the segment
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to read queue segment: %w", err)
+			}
+			offset += int64(len(line))
+			consumed++
+			last = position{seq: seg.seq, offset: offset, consumed: consumed}
+
+			var payload protocol.MetricsPayload
+			if err := json.Unmarshal(line, &payload); err != nil {
+				continue
+			}
+			if q.opts.expired(&payload, now) {
+				continue
+			}
+
+			out = append(out, &payload)
+			q.peeked = append(q.peeked, last)
+		}
+		f.Close()
+	}
+
+	// Nothing usable was found; consume the skipped records right away
+	if len(out) == 0 && consumed > 0 {
+		q.logger.Warn("Dropped expired or corrupt payloads from queue",
+			zap.Int("dropped", consumed),
+			zap.Duration("max_age", q.opts.MaxAge),
+		)
+		q.dropped += uint64(consumed)
+		q.pending -= consumed
+		if err := q.commit(last); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// Ack removes the first n payloads returned by the last Peek
+func (q *Disk) Ack(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The peeked payloads were dropped in the meantime; nothing left to remove
+	if len(q.peeked) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(q.peeked) {
+		return fmt.Errorf("ack of %d payloads exceeds %d peeked", n, len(q.peeked))
+	}
+
+	pos := q.peeked[n-1]
+	if skipped := pos.consumed - n; skipped > 0 {
+		q.dropped += uint64(skipped)
+	}
+	q.pending -= pos.consumed
+	q.peeked = nil
+
+	return q.commit(pos)
+}
+
+// Len returns the number of pending payloads
+func (q *Disk) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Stats returns queue depth and drop accounting
+func (q *Disk) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		Pending: q.pending,
+		Bytes:   q.totalBytes(),
+		Dropped: q.dropped,
+	}
+}
+
+// Close closes the head segment and persists the cursor
+func (q *Disk) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.head != nil {
+		q.head.Close()
+		q.head = nil
+	}
+	return q.saveCursor()
+}
+
+// commit moves the cursor to pos and deletes fully consumed segments
+func (q *Disk) commit(pos position) error {
+	q.cursor = position{seq: pos.seq, offset: pos.offset}
+
+	for len(q.segments) > 1 {
+		seg := q.segments[0]
+		done := seg.seq < q.cursor.seq || (seg.seq == q.cursor.seq && q.cursor.offset >= seg.size)
+		if !done {
+			break
+		}
+		if err := os.Remove(q.segmentPath(seg.seq)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove queue segment: %w", err)
+		}
+		q.segments = q.segments[1:]
+		if q.cursor.seq <= seg.seq {
+			q.cursor = position{seq: q.segments[0].seq}
+		}
+	}
+
+	return q.saveCursor()
+}
+
+// enforceLimits drops whole segments, oldest first, until the queue is
+// within its size cap and no sealed segment is older than the max age
+func (q *Disk) enforceLimits() {
+	cutoff := time.Now().Add(-q.opts.MaxAge)
+
+	for len(q.segments) > 1 {
+		overSize := q.totalBytes() > q.opts.MaxBytes
+		tooOld := false
+		if !overSize && q.opts.MaxAge > 0 {
+			if info, err := os.Stat(q.segmentPath(q.segments[0].seq)); err == nil {
+				tooOld = info.ModTime().Before(cutoff)
+			}
+		}
+		if !overSize && !tooOld {
+			return
+		}
+
+		seg := q.segments[0]
+		n, _ := q.countRecords(seg.seq, q.offsetIn(seg.seq))
+		os.Remove(q.segmentPath(seg.seq))
+		q.segments = q.segments[1:]
+		q.cursor = position{seq: q.segments[0].seq}
+		q.peeked = nil
+		q.pending -= n
+		q.dropped += uint64(n)
+		q.saveCursor()
+
+		reason := "size"
+		if !overSize {
+			reason = "age"
+		}
+		q.logger.Warn("Queue limit reached, dropped oldest segment",
+			zap.String("reason", reason),
+			zap.Int("dropped", n),
+			zap.Uint64("dropped_total", q.dropped),
+		)
+	}
+}
+
+// rotate seals the current head and starts a new segment
+func (q *Disk) rotate() error {
+	if q.head != nil {
+		q.head.Close()
+		q.head = nil
+	}
+
+	seq := uint64(1)
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1].seq + 1
+	}
+
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %w", err)
+	}
+
+	q.head = f
+	q.segments = append(q.segments, segment{seq: seq})
+	return nil
+}
+
+// saveCursor atomically persists the read position
+func (q *Disk) saveCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d\n", q.cursor.seq, q.cursor.offset)
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to write queue cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write queue cursor: %w", err)
+	}
+	return nil
+}
+
+// countRecords counts complete records in a segment from offset onwards
+func (q *Disk) countRecords(seq uint64, offset int64) (int, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek queue segment: %w", err)
+	}
+
+	count := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to read queue segment: %w", err)
+		}
+	}
+}
+
+// hasSegment reports whether seq is one of the loaded segments
+func (q *Disk) hasSegment(seq uint64) bool {
+	for _, seg := range q.segments {
+		if seg.seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// offsetIn returns the read offset to start from in the given segment
+func (q *Disk) offsetIn(seq uint64) int64 {
+	if seq == q.cursor.seq {
+		return q.cursor.offset
+	}
+	return 0
+}
+
+func (q *Disk) totalBytes() int64 {
+	var total int64
+	for _, seg := range q.segments {
+		total += seg.size
+	}
+	return total
+}
+
+func (q *Disk) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
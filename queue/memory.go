@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+// Memory is an in-memory queue used when no state directory is available.
+// It enforces the same limits as Disk but does not survive restarts.
+type Memory struct {
+	opts   Options
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	items   []memItem
+	bytes   int64
+	dropped uint64
+	peeked  int
+}
+
+type memItem struct {
+	payload *protocol.MetricsPayload
+	size    int64
+}
+
+// NewMemory creates a new in-memory queue
+func NewMemory(opts Options, logger *zap.Logger) *Memory {
+	return &Memory{
+		opts:   opts.withDefaults(),
+		logger: logger,
+	}
+}
+
+// Push appends a payload, dropping the oldest ones if the size cap is exceeded
+func (q *Memory) Push(payload *protocol.MetricsPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, memItem{payload: payload, size: int64(len(data))})
+	q.bytes += int64(len(data))
+
+	dropped := 0
+	for q.bytes > q.opts.MaxBytes && len(q.items) > 1 {
+		q.removeHead(1)
+		dropped++
+	}
+	if dropped > 0 {
+		q.dropped += uint64(dropped)
+		q.peeked = 0
+		q.logger.Warn("Queue full, dropped oldest payloads",
+			zap.Int("dropped", dropped),
+			zap.Uint64("dropped_total", q.dropped),
+		)
+	}
+
+	return nil
+}
+
+// Peek returns up to n payloads from the head, discarding expired ones
+func (q *Memory) Peek(n int) ([]*protocol.MetricsPayload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for len(q.items) > 0 && q.opts.expired(q.items[0].payload, now) {
+		q.removeHead(1)
+		expired++
+	}
+	if expired > 0 {
+		q.dropped += uint64(expired)
+		q.logger.Warn("Dropped expired payloads from queue",
+			zap.Int("dropped", expired),
+			zap.Duration("max_age", q.opts.MaxAge),
+		)
+	}
+
+	if n > len(q.items) {
+		n = len(q.items)
+	}
+	out := make([]*protocol.MetricsPayload, n)
+	for i := 0; i < n; i++ {
+		out[i] = q.items[i].payload
+	}
+	q.peeked = n
+
+	return out, nil
+}
+
+// Ack removes the first n payloads returned by the last Peek
+func (q *Memory) Ack(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The peeked payloads were dropped in the meantime; nothing left to remove
+	if q.peeked == 0 || n <= 0 {
+		return nil
+	}
+	if n > q.peeked {
+		return fmt.Errorf("ack of %d payloads exceeds %d peeked", n, q.peeked)
+	}
+
+	q.removeHead(n)
+	q.peeked = 0
+	return nil
+}
+
+// Len returns the number of pending payloads
+func (q *Memory) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Stats returns queue depth and drop accounting
+func (q *Memory) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		Pending: len(q.items),
+		Bytes:   q.bytes,
+		Dropped: q.dropped,
+	}
+}
+
+// Close is a no-op for the in-memory queue
+func (q *Memory) Close() error {
+	return nil
+}
+
+// removeHead removes the first n items
+func (q *Memory) removeHead(n int) {
+	for i := 0; i < n; i++ {
+		q.bytes -= q.items[i].size
+		q.items[i] = memItem{}
+	}
+	q.items = q.items[n:]
+}
@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Queue buffers payloads between collection and sending.
+//
+// Payloads are replayed oldest-first, in the order they were pushed. The
+// agent pushes each payload as it is collected, so push order is RecordedAt
+// order unless the wall clock is stepped back or a payload the API did not
+// accept from a batch is pushed again for retry. Delivery is at-least-once:
+// a payload is only removed once Ack confirms it was sent.
+type Queue interface {
+	// Push appends a payload to the tail of the queue
+	Push(payload *protocol.MetricsPayload) error
+	// Peek returns up to n payloads from the head without removing them
+	Peek(n int) ([]*protocol.MetricsPayload, error)
+	// Ack removes the first n payloads returned by the last Peek
+	Ack(n int) error
+	// Len returns the number of pending payloads
+	Len() int
+	// Stats returns queue depth and drop accounting
+	Stats() Stats
+	// Close releases any resources held by the queue
+	Close() error
+}
+
+// Options configures queue limits
+type Options struct {
+	MaxBytes     int64         // Total size cap; oldest payloads are dropped beyond it
+	MaxAge       time.Duration // Payloads older than this are dropped instead of sent
+	SegmentBytes int64         // Size at which the disk queue starts a new segment file
+}
+
+// Stats reports queue depth and drop accounting
+type Stats struct {
+	Pending int
+	Bytes   int64
+	Dropped uint64
+}
+
+const (
+	defaultMaxBytes     = 64 * 1024 * 1024 // 64MB
+	defaultSegmentBytes = 1024 * 1024      // 1MB
+)
+
+// withDefaults fills in zero limits
+func (o Options) withDefaults() Options {
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = defaultMaxBytes
+	}
+	if o.SegmentBytes <= 0 {
+		o.SegmentBytes = defaultSegmentBytes
+	}
+	// Keep several segments within the cap so dropping one frees a fraction of it
+	if o.SegmentBytes > o.MaxBytes/4 {
+		o.SegmentBytes = o.MaxBytes / 4
+	}
+	return o
+}
+
+// expired reports whether a payload is older than the configured max age
+func (o Options) expired(p *protocol.MetricsPayload, now time.Time) bool {
+	return o.MaxAge > 0 && !p.RecordedAt.IsZero() && now.Sub(p.RecordedAt) > o.MaxAge
+}
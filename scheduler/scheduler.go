@@ -1,35 +1,187 @@
 package scheduler
 
 import (
+	"context"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 )
 
-// Scheduler manages collection intervals with jitter
+// Schedule decides when a job runs
+type Schedule interface {
+	// Next returns the first run time strictly after t
+	Next(t time.Time) time.Time
+}
+
+// Every returns a schedule that runs at multiples of interval, aligned to
+// wall-clock boundaries so that agents collecting at the same interval
+// share timestamps: every minute on the minute, every 5m at :00, :05...
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	return t.Truncate(d).Add(d)
+}
+
+// Tick is one scheduled collection
+type Tick struct {
+	At      time.Time // The aligned slot, without the jitter offset
+	Default bool      // Whether the default interval is due
+	Jobs    []string  // Named schedules due, in name order
+
+	scheduled map[string]bool
+}
+
+// Due reports whether the named job runs in this tick. Jobs without a
+// schedule of their own follow the default interval.
+func (t Tick) Due(name string) bool {
+	if !t.scheduled[name] {
+		return t.Default
+	}
+	for _, job := range t.Jobs {
+		if job == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduler drives a default collection interval plus any number of named
+// schedules. Runs happen on wall-clock aligned slots; jitter only adds a
+// fixed offset, chosen once per scheduler, so the fleet does not hit the
+// API at the same instant while timestamps still line up.
 type Scheduler struct {
-	interval time.Duration
-	jitter   time.Duration
+	mu        sync.Mutex
+	interval  time.Duration
+	jitter    time.Duration
+	offset    time.Duration
+	schedules map[string]Schedule
+	last      time.Time // Slot of the last tick
+	wake      chan struct{}
 }
 
 // NewScheduler creates a new scheduler
 func NewScheduler(interval, jitter time.Duration) *Scheduler {
-	return &Scheduler{
-		interval: interval,
-		jitter:   jitter,
+	s := &Scheduler{
+		interval:  interval,
+		schedules: make(map[string]Schedule),
+		wake:      make(chan struct{}, 1),
+	}
+	s.setJitter(jitter)
+	return s
+}
+
+// SetInterval changes the default interval and jitter. The current wait
+// is recomputed, so a shorter interval takes effect immediately.
+func (s *Scheduler) SetInterval(interval, jitter time.Duration) {
+	s.mu.Lock()
+	s.interval = interval
+	s.setJitter(jitter)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// SetSchedule gives a job its own schedule; nil makes it follow the
+// default interval again
+func (s *Scheduler) SetSchedule(name string, schedule Schedule) {
+	s.mu.Lock()
+	if schedule == nil {
+		delete(s.schedules, name)
+	} else {
+		s.schedules[name] = schedule
 	}
+	s.mu.Unlock()
+
+	s.notify()
 }
 
-// Next returns the next collection time with jitter applied
-func (s *Scheduler) Next() time.Duration {
-	if s.jitter > 0 {
-		jitterAmount := time.Duration(rand.Int63n(int64(s.jitter)))
-		return s.interval + jitterAmount
+// setJitter picks a new offset when the jitter changes
+func (s *Scheduler) setJitter(jitter time.Duration) {
+	if jitter == s.jitter {
+		return
+	}
+	s.jitter = jitter
+	s.offset = 0
+	if jitter > 0 {
+		s.offset = time.Duration(rand.Int63n(int64(jitter)))
 	}
-	return s.interval
 }
 
-// Wait waits for the next scheduled time
-func (s *Scheduler) Wait() {
-	time.Sleep(s.Next())
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
 }
 
+// Wait waits for the next tick, returning early with the context's error
+// if it is cancelled. Slots missed while the previous tick was handled are
+// skipped rather than run back to back.
+func (s *Scheduler) Wait(ctx context.Context) (Tick, error) {
+	for {
+		s.mu.Lock()
+		offset := s.offset
+		if s.interval > 0 {
+			offset %= s.interval
+		}
+		from := s.last
+		if now := time.Now().Add(-offset); now.After(from) {
+			from = now
+		}
+		tick := s.next(from)
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(tick.At.Add(offset)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Tick{}, ctx.Err()
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+			s.mu.Lock()
+			s.last = tick.At
+			s.mu.Unlock()
+			return tick, nil
+		}
+	}
+}
+
+// next returns the earliest tick after from; s.mu must be held
+func (s *Scheduler) next(from time.Time) Tick {
+	tick := Tick{scheduled: make(map[string]bool, len(s.schedules))}
+
+	var defaultAt time.Time
+	if s.interval > 0 {
+		defaultAt = Every(s.interval).Next(from)
+		tick.At = defaultAt
+	}
+
+	due := make(map[string]time.Time, len(s.schedules))
+	for name, schedule := range s.schedules {
+		tick.scheduled[name] = true
+		at := schedule.Next(from)
+		if at.IsZero() {
+			continue
+		}
+		due[name] = at
+		if tick.At.IsZero() || at.Before(tick.At) {
+			tick.At = at
+		}
+	}
+
+	tick.Default = !defaultAt.IsZero() && defaultAt.Equal(tick.At)
+	for name, at := range due {
+		if at.Equal(tick.At) {
+			tick.Jobs = append(tick.Jobs, name)
+		}
+	}
+	sort.Strings(tick.Jobs)
+	return tick
+}
@@ -0,0 +1,179 @@
+package sender
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is returned while the breaker is holding off requests
+var ErrCircuitOpen = errors.New("circuit breaker open: endpoint unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker stops requests to an endpoint after repeated failures.
+//
+// After threshold consecutive failures it opens and rejects requests for the
+// cooldown period. It then lets a single probe through: success closes it,
+// failure opens it again. A threshold of zero disables the breaker.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    *zap.Logger
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewBreaker creates a new circuit breaker
+func NewBreaker(threshold int, cooldown time.Duration, logger *zap.Logger) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+	}
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent now
+func (b *Breaker) Allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		b.logger.Info("Circuit breaker half-open, probing endpoint")
+		return nil
+	case breakerHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success records that the endpoint answered
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		b.logger.Info("Circuit breaker closed, endpoint recovered")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request and opens the breaker once the
+// threshold is reached or a probe fails
+func (b *Breaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.open(b.cooldown)
+	}
+}
+
+// Release ends a request that was abandoned without an answer, e.g. on
+// shutdown, leaving the state unchanged. If it was the probe, the next
+// request may probe instead.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// OpenFor opens the breaker for at least d, e.g. when the API asks clients
+// to back off for longer than a retry would wait
+func (b *Breaker) OpenFor(d time.Duration) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if d < b.cooldown {
+		d = b.cooldown
+	}
+	b.open(d)
+}
+
+// RetryIn returns how long until the breaker lets a probe through,
+// or zero if it is closed
+func (b *Breaker) RetryIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	if d := time.Until(b.openUntil); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// State returns the breaker state as a string
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
+
+func (b *Breaker) open(d time.Duration) {
+	until := time.Now().Add(d)
+	if b.state == breakerOpen && until.Before(b.openUntil) {
+		return
+	}
+	if b.state != breakerOpen {
+		b.logger.Warn("Circuit breaker open, pausing requests",
+			zap.Int("failures", b.failures),
+			zap.Duration("cooldown", d),
+		)
+	}
+	b.state = breakerOpen
+	b.openUntil = until
+	b.probing = false
+}
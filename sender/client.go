@@ -2,7 +2,7 @@ package sender
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +11,7 @@ import (
 
 	"github.com/pingxeno/agent/config"
 	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/signing"
 	"go.uber.org/zap"
 )
 
@@ -18,77 +19,276 @@ import (
 type Client struct {
 	config     *config.Config
 	httpClient *http.Client
+	compressor *compressor
+	signer     *signing.Signer
+	proxy      *proxyRouter
+	endpoints  *endpointPool
+	onConfig   func(*protocol.RemoteConfig)
 	logger     *zap.Logger
 }
 
 // NewClient creates a new API client
-func NewClient(cfg *config.Config, logger *zap.Logger) *Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: cfg.Security.TLSSkipVerify,
-		},
+func NewClient(cfg *config.Config, logger *zap.Logger) (*Client, error) {
+	client, proxy, err := newHTTPClient(cfg, logger)
+	if err != nil {
+		return nil, err
 	}
 
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   cfg.Security.Timeout,
+	endpoints, err := newEndpointPool(cfg.Server, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	comp, err := newCompressor(cfg.Sender.Compression, cfg.Sender.CompressionMinBytes)
+	if err != nil {
+		logger.Warn("Invalid compression setting, sending uncompressed", zap.Error(err))
+		comp, _ = newCompressor(CompressionNone, 0)
+	}
+
+	var signer *signing.Signer
+	if cfg.Security.SigningSecret != "" {
+		signer = signing.NewSigner([]byte(cfg.Security.SigningSecret))
 	}
 
 	return &Client{
 		config:     cfg,
-		httpClient:  client,
+		httpClient: client,
+		compressor: comp,
+		signer:     signer,
+		proxy:      proxy,
+		endpoints:  endpoints,
 		logger:     logger,
+	}, nil
+}
+
+// newHTTPClient builds an HTTP client with the configured TLS, proxy and
+// timeout settings
+func newHTTPClient(cfg *config.Config, logger *zap.Logger) (*http.Client, *proxyRouter, error) {
+	tlsSource, err := newTLSSource(cfg.Security, logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+
+	proxy, err := newProxyRouter(cfg.Proxy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid proxy settings: %w", err)
 	}
+
+	client := &http.Client{
+		Transport: &transport{tls: tlsSource, proxy: proxy.proxy},
+		Timeout:   cfg.Security.Timeout,
+	}
+
+	return client, proxy, nil
 }
 
 // SendMetrics sends metrics payload to the API
-func (c *Client) SendMetrics(payload *protocol.MetricsPayload) error {
-	payload.ServerKey = c.config.Server.ServerKey
+func (c *Client) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	// Payloads are shared between outputs, so the key is set on a copy
+	keyed := *payload
+	keyed.ServerKey = c.config.Server.ServerKey
 
-	jsonData, err := json.Marshal(payload)
+	jsonData, err := json.Marshal(&keyed)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return permanent(fmt.Errorf("failed to marshal payload: %w", err))
 	}
 
-	req, err := http.NewRequest("POST", c.config.Server.APIURL, bytes.NewBuffer(jsonData))
+	body, err := c.post(ctx, jsonData)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
+	}
+
+	var response protocol.MetricsResponse
+	if err := json.Unmarshal(body, &response); err == nil {
+		c.logger.Info("Metrics sent successfully",
+			zap.String("server_id", fmt.Sprintf("%v", response.ServerID)),
+			zap.String("stat_id", fmt.Sprintf("%v", response.StatID)),
+		)
+		c.receivedConfig(response.Config)
+	}
+
+	return nil
+}
+
+// OnConfig registers a function called with every configuration revision
+// the API returns. It must be set before anything is sent.
+func (c *Client) OnConfig(fn func(*protocol.RemoteConfig)) {
+	c.onConfig = fn
+}
+
+// receivedConfig passes a configuration revision on, if the API sent one
+func (c *Client) receivedConfig(rc *protocol.RemoteConfig) {
+	if rc != nil && c.onConfig != nil {
+		c.onConfig(rc)
+	}
+}
+
+// ItemError reports that the API rejected one item of a batch
+type ItemError struct {
+	Index     int
+	Message   string
+	Retryable bool
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d rejected: %s", e.Index, e.Message)
+}
+
+// SendBatch sends several payloads as a single JSON array request.
+// It returns one error per payload (nil if the API accepted it), or a
+// request-level error if the batch as a whole could not be delivered.
+func (c *Client) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	keyed := make([]protocol.MetricsPayload, len(payloads))
+	for i, payload := range payloads {
+		keyed[i] = *payload
+		keyed[i].ServerKey = c.config.Server.ServerKey
+	}
+
+	jsonData, err := json.Marshal(keyed)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to marshal batch: %w", err))
+	}
+
+	body, err := c.post(ctx, jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]error, len(payloads))
+
+	var response protocol.BatchResponse
+	err = json.Unmarshal(body, &response)
+	if err == nil {
+		c.receivedConfig(response.Config)
+	}
+	if err != nil || len(response.Results) == 0 {
+		// No per-item results: the whole batch was accepted
+		c.logger.Info("Metrics batch sent successfully", zap.Int("items", len(payloads)))
+		return results, nil
+	}
+
+	// Items the API did not report on are retried
+	reported := make([]bool, len(payloads))
+	for _, result := range response.Results {
+		if result.Index < 0 || result.Index >= len(payloads) {
+			continue
+		}
+		reported[result.Index] = true
+		if !result.Accepted {
+			results[result.Index] = &ItemError{
+				Index:     result.Index,
+				Message:   result.Error,
+				Retryable: result.Retryable,
+			}
+		}
+	}
+
+	rejected := 0
+	for i := range payloads {
+		if !reported[i] {
+			results[i] = &ItemError{Index: i, Message: "no result in response", Retryable: true}
+		}
+		if results[i] != nil {
+			rejected++
+		}
+	}
+
+	c.logger.Info("Metrics batch sent",
+		zap.Int("items", len(payloads)),
+		zap.Int("accepted", len(payloads)-rejected),
+		zap.Int("rejected", rejected),
+	)
+
+	return results, nil
+}
+
+// post sends a JSON body to the API, compressing it if configured, and
+// returns the response body of a successful request
+func (c *Client) post(ctx context.Context, jsonData []byte) ([]byte, error) {
+	data, encoding, err := c.compressor.compress(jsonData)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	if encoding != "" {
+		c.logger.Debug("Compressed request body",
+			zap.String("encoding", encoding),
+			zap.Int("uncompressed_bytes", len(jsonData)),
+			zap.Int("compressed_bytes", len(data)),
+		)
+	}
+
+	endpoint := c.endpoints.current(ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to create request: %w", err))
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-API-Key", c.config.Server.APIKey)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if c.signer != nil {
+		if err := c.signer.Sign(req, data); err != nil {
+			return nil, permanent(err)
+		}
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		if ctx.Err() == nil {
+			c.endpoints.failed(endpoint, err)
+		}
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API returned error: %d - %s", resp.StatusCode, string(body))
+	// Server errors mean the endpoint is unhealthy; any other answer,
+	// including a rejection, shows it is up
+	if resp.StatusCode >= 500 {
+		c.endpoints.failed(endpoint, fmt.Errorf("API returned status %d", resp.StatusCode))
+	} else {
+		c.endpoints.succeeded(endpoint)
 	}
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err == nil {
-		c.logger.Info("Metrics sent successfully",
-			zap.String("server_id", fmt.Sprintf("%v", response["server_id"])),
-			zap.String("stat_id", fmt.Sprintf("%v", response["stat_id"])),
-		)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
+	return body, nil
+}
+
+// Close releases idle connections
+func (c *Client) Close() error {
+	c.httpClient.CloseIdleConnections()
 	return nil
 }
 
+// ProxyRoute describes how requests reach the API: "direct" or
+// "via <proxy url>", for the last request sent
+func (c *Client) ProxyRoute() string {
+	return c.proxy.route(c.endpoints.activeEndpoint())
+}
+
+// ActiveEndpoint returns the API endpoint requests are currently sent to
+func (c *Client) ActiveEndpoint() string {
+	return c.endpoints.activeEndpoint()
+}
+
 // TestConnection tests the connection to the API
-func (c *Client) TestConnection() error {
+func (c *Client) TestConnection(ctx context.Context) error {
 	// Create a minimal test payload
 	testPayload := &protocol.MetricsPayload{
 		ServerKey:  c.config.Server.ServerKey,
 		RecordedAt: time.Now(),
 	}
 
-	return c.SendMetrics(testPayload)
+	return c.SendMetrics(ctx, testPayload)
 }
 
@@ -0,0 +1,73 @@
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported request body compression algorithms
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressor encodes request bodies that are at least minBytes long
+type compressor struct {
+	algorithm string
+	minBytes  int
+	zstdEnc   *zstd.Encoder
+}
+
+// newCompressor creates a compressor for the given algorithm
+func newCompressor(algorithm string, minBytes int) (*compressor, error) {
+	c := &compressor{
+		algorithm: algorithm,
+		minBytes:  minBytes,
+	}
+
+	switch algorithm {
+	case "", CompressionNone:
+		c.algorithm = CompressionNone
+	case CompressionGzip:
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		c.zstdEnc = enc
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+
+	return c, nil
+}
+
+// compress returns the encoded body and its Content-Encoding, or the body
+// unchanged and an empty encoding if it is below the threshold
+func (c *compressor) compress(data []byte) ([]byte, string, error) {
+	if c.algorithm == CompressionNone || len(data) < c.minBytes {
+		return data, "", nil
+	}
+
+	switch c.algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", fmt.Errorf("failed to gzip body: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to gzip body: %w", err)
+		}
+		return buf.Bytes(), CompressionGzip, nil
+	case CompressionZstd:
+		// EncodeAll is safe for concurrent use
+		return c.zstdEnc.EncodeAll(data, make([]byte, 0, len(data)/4)), CompressionZstd, nil
+	}
+
+	return data, "", nil
+}
@@ -0,0 +1,181 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"go.uber.org/zap"
+)
+
+// srvRefresh is how long SRV discovery results are reused
+const srvRefresh = 5 * time.Minute
+
+// endpointPool picks the API endpoint to send to. Endpoints are tried in
+// order of preference: a failing endpoint is skipped until failback_after
+// has passed, after which the agent returns to it.
+type endpointPool struct {
+	static   []string
+	srv      string
+	template *url.URL // Scheme and path for endpoints discovered through SRV
+	cooldown time.Duration
+	lookup   func(ctx context.Context, name string) ([]*net.SRV, error)
+	now      func() time.Time
+	logger   *zap.Logger
+
+	mu         sync.Mutex
+	discovered []string
+	resolvedAt time.Time
+	failedAt   map[string]time.Time
+	active     string
+}
+
+// newEndpointPool builds the pool from api_url, fallback_urls and srv_record
+func newEndpointPool(server config.ServerConfig, logger *zap.Logger) (*endpointPool, error) {
+	static := []string{server.APIURL}
+	for _, u := range server.FallbackURLs {
+		if u != "" && u != server.APIURL {
+			static = append(static, u)
+		}
+	}
+
+	p := &endpointPool{
+		static:   static,
+		srv:      server.SRVRecord,
+		cooldown: server.FailbackAfter,
+		lookup: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return addrs, err
+		},
+		now:      time.Now,
+		logger:   logger,
+		failedAt: make(map[string]time.Time),
+	}
+
+	if p.srv != "" {
+		template, err := url.Parse(server.APIURL)
+		if err != nil || template.Scheme == "" {
+			return nil, fmt.Errorf("api_url %q is needed as the scheme and path for SRV endpoints", server.APIURL)
+		}
+		p.template = template
+	}
+
+	return p, nil
+}
+
+// current returns the endpoint to send the next request to: the first one
+// that has not failed within the cooldown, or the one that failed longest
+// ago if all of them are failing
+func (p *endpointPool) current(ctx context.Context) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := p.candidates(ctx)
+	now := p.now()
+
+	selected := ""
+	var oldest time.Time
+	for _, endpoint := range candidates {
+		failedAt, failed := p.failedAt[endpoint]
+		if !failed || now.Sub(failedAt) >= p.cooldown {
+			selected = endpoint
+			break
+		}
+		if selected == "" || failedAt.Before(oldest) {
+			selected, oldest = endpoint, failedAt
+		}
+	}
+
+	if selected != p.active {
+		if p.active != "" {
+			p.logger.Info("Switched API endpoint",
+				zap.String("from", p.active),
+				zap.String("to", selected),
+			)
+		}
+		p.active = selected
+	}
+	return selected
+}
+
+// failed marks an endpoint as unhealthy, so the next request goes to the
+// next one in order
+func (p *endpointPool) failed(endpoint string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	prev, known := p.failedAt[endpoint]
+	if (!known || now.Sub(prev) >= p.cooldown) && len(p.static)+len(p.discovered) > 1 {
+		p.logger.Warn("API endpoint failed, failing over",
+			zap.String("endpoint", endpoint),
+			zap.Duration("failback_after", p.cooldown),
+			zap.Error(err),
+		)
+	}
+	p.failedAt[endpoint] = now
+}
+
+// succeeded clears an endpoint's failure
+func (p *endpointPool) succeeded(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failedAt, endpoint)
+}
+
+// activeEndpoint returns the endpoint in use, or the preferred one if no
+// request has been made yet
+func (p *endpointPool) activeEndpoint() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active != "" {
+		return p.active
+	}
+	if len(p.discovered) > 0 {
+		return p.discovered[0]
+	}
+	return p.static[0]
+}
+
+// candidates returns the endpoints in order of preference. Endpoints found
+// through SRV come first, with the configured URLs as a fallback for when
+// discovery fails.
+func (p *endpointPool) candidates(ctx context.Context) []string {
+	if p.srv == "" {
+		return p.static
+	}
+
+	if p.now().Sub(p.resolvedAt) >= srvRefresh {
+		p.resolvedAt = p.now()
+
+		addrs, err := p.lookup(ctx, p.srv)
+		if err != nil {
+			p.logger.Warn("SRV lookup failed", zap.String("record", p.srv), zap.Error(err))
+		} else {
+			// Records come sorted by priority and shuffled by weight
+			discovered := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				u := *p.template
+				u.Host = net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+				discovered = append(discovered, u.String())
+			}
+			p.discovered = discovered
+			p.logger.Debug("Resolved API endpoints",
+				zap.String("record", p.srv),
+				zap.Strings("endpoints", discovered),
+			)
+		}
+	}
+
+	if len(p.discovered) == 0 {
+		return p.static
+	}
+	return append(append([]string{}, p.discovered...), p.static...)
+}
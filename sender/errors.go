@@ -0,0 +1,103 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError is returned when the API responds with a non-success status
+type APIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // From the Retry-After header, if any
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned error: %d - %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *APIError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// permanentError marks a failure that happened before anything was sent,
+// such as a payload that cannot be encoded
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsRetryable reports whether a send error is worth retrying: network
+// errors, 5xx and 429 responses, and batch items the API marked retryable
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Retryable
+	}
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false
+	}
+
+	// Anything else failed in transport
+	return true
+}
+
+// IsRejected reports whether the API rejected the payload itself, so that
+// resending it can never succeed. Authentication and routing errors are not
+// rejections: they are fixed by configuration, after which the payload can
+// still be delivered.
+func IsRejected(err error) bool {
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		return !itemErr.Retryable
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Retryable() || apiErr.StatusCode < 400 {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusProxyAuthRequired, http.StatusRequestTimeout:
+		return false
+	}
+	return true
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pingxeno/agent/config"
+	"go.uber.org/zap"
+)
+
+// Poster sends pre-encoded bodies to an HTTP endpoint using the agent's
+// TLS, proxy and compression settings. Sinks for other backends build on
+// it so their errors are classified like the API client's.
+type Poster struct {
+	httpClient *http.Client
+	download   *http.Client // Same transport without security.timeout
+	compressor *compressor
+	logger     *zap.Logger
+}
+
+// NewPoster creates a poster from the security, proxy and sender sections
+func NewPoster(cfg *config.Config, logger *zap.Logger) (*Poster, error) {
+	client, _, err := newHTTPClient(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	comp, err := newCompressor(cfg.Sender.Compression, cfg.Sender.CompressionMinBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Poster{
+		httpClient: client,
+		download:   &http.Client{Transport: client.Transport},
+		compressor: comp,
+		logger:     logger,
+	}, nil
+}
+
+// NewExternalPoster creates a poster for hosts other than the API, such as
+// metrics backends and release hosts. It uses the same settings as
+// NewPoster, except that it neither offers the API client certificate nor
+// expects the server to be named security.server_name.
+func NewExternalPoster(cfg *config.Config, logger *zap.Logger) (*Poster, error) {
+	external := *cfg
+	external.Security.ClientCertFile = ""
+	external.Security.ClientKeyFile = ""
+	external.Security.ServerName = ""
+	return NewPoster(&external, logger)
+}
+
+// Post sends body to url with the given headers, compressing it if
+// configured. Any 2xx response is a success; other statuses are returned
+// as *APIError and transport failures are retryable.
+func (p *Poster) Post(ctx context.Context, url string, body []byte, header http.Header) ([]byte, error) {
+	data, encoding, err := p.compressor.compress(body)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to create request: %w", err))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return respBody, nil
+}
+
+// Get fetches url with the given headers. Statuses and transport failures
+// are classified as for Post.
+func (p *Poster) Get(ctx context.Context, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to create request: %w", err))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return respBody, nil
+}
+
+// Download copies the body of url to w. Unlike Get it is not limited by
+// security.timeout, which large files such as release binaries can take
+// longer than, so callers bound it with ctx. Statuses and transport
+// failures are classified as for Post.
+func (p *Poster) Download(ctx context.Context, url string, header http.Header, w io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, permanent(fmt.Errorf("failed to create request: %w", err))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := p.download.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return 0, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("failed to download: %w", err)
+	}
+	return n, nil
+}
+
+// Permanent marks an error as not worth retrying, such as a payload that
+// cannot be encoded
+func Permanent(err error) error {
+	return permanent(err)
+}
+
+// Close releases idle connections
+func (p *Poster) Close() error {
+	p.httpClient.CloseIdleConnections()
+	return nil
+}
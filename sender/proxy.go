@@ -0,0 +1,106 @@
+package sender
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pingxeno/agent/config"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// routeDirect is reported when a request bypasses the proxy
+const routeDirect = "direct"
+
+// proxyRouter selects the proxy for each request and remembers the route
+// the last request took
+type proxyRouter struct {
+	proxyFunc func(*url.URL) (*url.URL, error)
+
+	mu   sync.Mutex
+	last string
+}
+
+// newProxyRouter builds a router from the proxy section. Without a
+// configured URL it falls back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newProxyRouter(cfg config.ProxyConfig) (*proxyRouter, error) {
+	var pc *httpproxy.Config
+
+	if cfg.URL == "" {
+		pc = httpproxy.FromEnvironment()
+	} else {
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", u.Scheme)
+		}
+		if cfg.Username != "" {
+			u.User = url.UserPassword(cfg.Username, cfg.Password)
+		}
+
+		pc = &httpproxy.Config{
+			HTTPProxy:  u.String(),
+			HTTPSProxy: u.String(),
+		}
+	}
+
+	if len(cfg.NoProxy) > 0 {
+		noProxy := strings.Join(cfg.NoProxy, ",")
+		if pc.NoProxy != "" {
+			noProxy = pc.NoProxy + "," + noProxy
+		}
+		pc.NoProxy = noProxy
+	}
+
+	return &proxyRouter{proxyFunc: pc.ProxyFunc()}, nil
+}
+
+// proxy implements http.Transport.Proxy. The transport tunnels HTTPS
+// through HTTP(S) proxies with CONNECT and dials SOCKS5 proxies directly.
+func (p *proxyRouter) proxy(req *http.Request) (*url.URL, error) {
+	u, err := p.proxyFunc(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.last = describeRoute(u)
+	p.mu.Unlock()
+
+	return u, nil
+}
+
+// route returns the route the last request took, or the one a request to
+// target would take if nothing has been sent yet
+func (p *proxyRouter) route(target string) string {
+	p.mu.Lock()
+	last := p.last
+	p.mu.Unlock()
+	if last != "" {
+		return last
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return routeDirect
+	}
+	proxyURL, err := p.proxyFunc(u)
+	if err != nil {
+		return routeDirect
+	}
+	return describeRoute(proxyURL)
+}
+
+// describeRoute formats a proxy URL without its password
+func describeRoute(u *url.URL) string {
+	if u == nil {
+		return routeDirect
+	}
+	return "via " + u.Redacted()
+}
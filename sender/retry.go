@@ -1,45 +1,80 @@
 package sender
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/pingxeno/agent/protocol"
 	"go.uber.org/zap"
 )
 
-// RetrySender wraps a client with retry logic
-type RetrySender struct {
-	client *Client
-	config *struct {
-		Attempts int
-		Backoff  time.Duration
+// RetryPolicy controls how failed sends are retried
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration // Base delay, doubled on every attempt
+	MaxBackoff time.Duration // Cap on the delay between attempts
+}
+
+// delay returns a full-jitter exponential backoff for the given attempt:
+// a random duration between zero and min(MaxBackoff, Backoff*2^(attempt-1))
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := p.MaxBackoff
+	if attempt < 32 {
+		if d := p.Backoff << uint(attempt-1); d > 0 && (ceiling <= 0 || d < ceiling) {
+			ceiling = d
+		}
 	}
-	logger *zap.Logger
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Delay returns the backoff before retrying after the given attempt, for
+// callers that retry on their own schedule
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	return p.delay(attempt)
+}
+
+// RetrySender wraps a sink with retry logic and a circuit breaker
+type RetrySender struct {
+	sink    Sink
+	policy  RetryPolicy
+	breaker *Breaker
+	logger  *zap.Logger
 }
 
 // NewRetrySender creates a new retry sender
-func NewRetrySender(client *Client, attempts int, backoff time.Duration, logger *zap.Logger) *RetrySender {
+func NewRetrySender(sink Sink, policy RetryPolicy, breaker *Breaker, logger *zap.Logger) *RetrySender {
 	return &RetrySender{
-		client: client,
-		config: &struct {
-			Attempts int
-			Backoff  time.Duration
-		}{
-			Attempts: attempts,
-			Backoff:  backoff,
-		},
-		logger: logger,
+		sink:    sink,
+		policy:  policy,
+		breaker: breaker,
+		logger:  logger,
 	}
 }
 
-// SendWithRetry sends metrics with retry logic
-func (r *RetrySender) SendWithRetry(payload *protocol.MetricsPayload) error {
+// SendWithRetry sends metrics with retry logic. Only network errors, 5xx
+// and 429 responses are retried.
+func (r *RetrySender) SendWithRetry(ctx context.Context, payload *protocol.MetricsPayload) error {
 	var lastErr error
+	attempts := 0
+
+	for attempt := 1; attempt <= r.policy.Attempts; attempt++ {
+		if err := r.breaker.Allow(); err != nil {
+			if lastErr != nil {
+				return fmt.Errorf("%w (last error: %v)", err, lastErr)
+			}
+			return err
+		}
 
-	for attempt := 1; attempt <= r.config.Attempts; attempt++ {
-		err := r.client.SendMetrics(payload)
+		attempts++
+		err := r.sink.SendMetrics(ctx, payload)
 		if err == nil {
+			r.breaker.Success()
 			if attempt > 1 {
 				r.logger.Info("Successfully sent after retry",
 					zap.Int("attempt", attempt),
@@ -49,18 +84,159 @@ func (r *RetrySender) SendWithRetry(payload *protocol.MetricsPayload) error {
 		}
 
 		lastErr = err
+		if ctx.Err() != nil {
+			r.breaker.Release()
+			return ctx.Err()
+		}
+		if !IsRetryable(err) {
+			// The endpoint answered, so it is healthy even if it refused
+			r.breaker.Success()
+			return err
+		}
+		r.breaker.Failure()
+
+		if attempt == r.policy.Attempts {
+			break
+		}
+		wait, ok := r.wait(attempt, err)
+		if !ok {
+			break
+		}
+
 		r.logger.Warn("Failed to send metrics, retrying",
 			zap.Int("attempt", attempt),
-			zap.Int("max_attempts", r.config.Attempts),
+			zap.Int("max_attempts", r.policy.Attempts),
+			zap.Duration("backoff", wait),
 			zap.Error(err),
 		)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to send after %d attempts: %w", attempts, lastErr)
+}
+
+// SendBatchWithRetry sends a batch, retrying only the items that failed.
+// It returns the final error for each payload (nil if it was accepted).
+func (r *RetrySender) SendBatchWithRetry(ctx context.Context, payloads []*protocol.MetricsPayload) []error {
+	results := make([]error, len(payloads))
+	pending := make([]int, len(payloads))
+	for i := range payloads {
+		pending[i] = i
+	}
+
+	for attempt := 1; attempt <= r.policy.Attempts; attempt++ {
+		if err := r.breaker.Allow(); err != nil {
+			for _, i := range pending {
+				if results[i] == nil {
+					results[i] = err
+				}
+			}
+			return results
+		}
+
+		batch := make([]*protocol.MetricsPayload, len(pending))
+		for j, i := range pending {
+			batch[j] = payloads[i]
+		}
+
+		var retry []int
+		itemErrs, err := r.sink.SendBatch(ctx, batch)
+		if err != nil {
+			for _, i := range pending {
+				results[i] = err
+			}
+			if ctx.Err() != nil {
+				r.breaker.Release()
+				return results
+			}
+			if !IsRetryable(err) {
+				r.breaker.Success()
+				return results
+			}
+			r.breaker.Failure()
+			retry = pending
+		} else {
+			r.breaker.Success()
+			for j, i := range pending {
+				results[i] = itemErrs[j]
+				var itemErr *ItemError
+				if errors.As(itemErrs[j], &itemErr) {
+					// Report the index within the caller's batch
+					itemErr.Index = i
+					if itemErr.Retryable {
+						retry = append(retry, i)
+					}
+				}
+			}
+			if len(retry) == 0 {
+				if attempt > 1 {
+					r.logger.Info("Successfully sent batch after retry",
+						zap.Int("attempt", attempt),
+					)
+				}
+				return results
+			}
+		}
+		pending = retry
+
+		if attempt == r.policy.Attempts {
+			break
+		}
+		wait, ok := r.wait(attempt, err)
+		if !ok {
+			break
+		}
 
-		if attempt < r.config.Attempts {
-			backoff := time.Duration(attempt) * r.config.Backoff
-			time.Sleep(backoff)
+		r.logger.Warn("Failed to send metrics batch, retrying",
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", r.policy.Attempts),
+			zap.Int("items", len(pending)),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+		if sleep(ctx, wait) != nil {
+			return results
 		}
 	}
 
-	return fmt.Errorf("failed to send after %d attempts: %w", r.config.Attempts, lastErr)
+	return results
 }
 
+// RetryIn returns how long until the circuit breaker allows another
+// attempt, or zero if requests are not being held off
+func (r *RetrySender) RetryIn() time.Duration {
+	return r.breaker.RetryIn()
+}
+
+// wait returns the delay before the next attempt. A Retry-After from the
+// API takes precedence over the backoff; if it is longer than the maximum
+// backoff, the breaker is opened instead and ok is false.
+func (r *RetrySender) wait(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		if r.policy.MaxBackoff > 0 && apiErr.RetryAfter > r.policy.MaxBackoff {
+			r.logger.Warn("API asked to back off, pausing requests",
+				zap.Duration("retry_after", apiErr.RetryAfter),
+			)
+			r.breaker.OpenFor(apiErr.RetryAfter)
+			return 0, false
+		}
+		return apiErr.RetryAfter, true
+	}
+	return r.policy.delay(attempt), true
+}
+
+// sleep waits for d, returning early with the context's error if it is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"go.uber.org/zap"
+)
+
+// stubSink answers every request with the result of send
+type stubSink struct {
+	send func(ctx context.Context) error
+}
+
+func (s *stubSink) SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error {
+	return s.send(ctx)
+}
+
+func (s *stubSink) SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error) {
+	if err := s.send(ctx); err != nil {
+		return nil, err
+	}
+	return make([]error, len(payloads)), nil
+}
+
+func (s *stubSink) Close() error { return nil }
+
+// unavailable is a retryable request-level error
+var unavailable = &APIError{StatusCode: 503, Body: "unavailable"}
+
+func TestBreakerReleasedWhenProbeCancelled(t *testing.T) {
+	sends := map[string]func(r *RetrySender, ctx context.Context) error{
+		"single": func(r *RetrySender, ctx context.Context) error {
+			return r.SendWithRetry(ctx, &protocol.MetricsPayload{})
+		},
+		"batch": func(r *RetrySender, ctx context.Context) error {
+			return r.SendBatchWithRetry(ctx, []*protocol.MetricsPayload{{}})[0]
+		},
+	}
+
+	for name, send := range sends {
+		t.Run(name, func(t *testing.T) {
+			breaker := NewBreaker(1, time.Millisecond, zap.NewNop())
+			sink := &stubSink{send: func(context.Context) error { return unavailable }}
+			r := NewRetrySender(sink, RetryPolicy{Attempts: 1}, breaker, zap.NewNop())
+
+			// Open the breaker, then let the cooldown pass
+			send(r, context.Background())
+			if breaker.State() != "open" {
+				t.Fatalf("breaker is %s after a failure, want open", breaker.State())
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			// The probe is abandoned on shutdown
+			ctx, cancel := context.WithCancel(context.Background())
+			sink.send = func(ctx context.Context) error {
+				cancel()
+				return ctx.Err()
+			}
+			if err := send(r, ctx); !errors.Is(err, context.Canceled) {
+				t.Fatalf("cancelled probe returned %v", err)
+			}
+
+			// The next send may probe again and closes the breaker
+			sink.send = func(context.Context) error { return nil }
+			if err := send(r, context.Background()); err != nil {
+				t.Fatalf("send after a cancelled probe: %v", err)
+			}
+			if breaker.State() != "closed" {
+				t.Errorf("breaker is %s, want closed", breaker.State())
+			}
+		})
+	}
+}
+
+func TestRetrySender(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error // Result of each send in turn; nil once exhausted
+		calls    int
+		rejected bool
+	}{
+		{name: "accepted", calls: 1},
+		{name: "unavailable then accepted", errs: []error{unavailable}, calls: 2},
+		{name: "rate limited then accepted", errs: []error{&APIError{StatusCode: 429}}, calls: 2},
+		{name: "transport failure then accepted", errs: []error{errors.New("connection refused")}, calls: 2},
+		{name: "unavailable on every attempt", errs: []error{unavailable, unavailable, unavailable}, calls: 3},
+		{name: "rejected", errs: []error{&APIError{StatusCode: 400}}, calls: 1, rejected: true},
+	}
+
+	for _, tt := range tests {
+		for _, batch := range []bool{false, true} {
+			name := tt.name
+			if batch {
+				name += "/batch"
+			}
+			t.Run(name, func(t *testing.T) {
+				var calls int
+				sink := &stubSink{send: func(context.Context) error {
+					calls++
+					if calls <= len(tt.errs) {
+						return tt.errs[calls-1]
+					}
+					return nil
+				}}
+				r := NewRetrySender(sink,
+					RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+					NewBreaker(5, time.Minute, zap.NewNop()),
+					zap.NewNop(),
+				)
+
+				var err error
+				if batch {
+					err = r.SendBatchWithRetry(context.Background(), []*protocol.MetricsPayload{{}, {}})[1]
+				} else {
+					err = r.SendWithRetry(context.Background(), &protocol.MetricsPayload{})
+				}
+
+				if calls != tt.calls {
+					t.Errorf("sink got %d sends, want %d", calls, tt.calls)
+				}
+				if failed := calls == len(tt.errs); failed != (err != nil) {
+					t.Errorf("err = %v", err)
+				}
+				if IsRejected(err) != tt.rejected {
+					t.Errorf("IsRejected(%v) = %v, want %v", err, IsRejected(err), tt.rejected)
+				}
+			})
+		}
+	}
+}
+
+func TestPosterClassifiesStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		retryable bool
+		rejected  bool
+	}{
+		{http.StatusServiceUnavailable, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusBadRequest, false, true},
+	}
+
+	poster, err := NewPoster(config.DefaultConfig(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poster.Close()
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		_, err := poster.Post(context.Background(), srv.URL, []byte("{}"), nil)
+		srv.Close()
+
+		if err == nil {
+			t.Fatalf("status %d: no error", tt.status)
+		}
+		if got := IsRetryable(err); got != tt.retryable {
+			t.Errorf("status %d: IsRetryable = %v, want %v", tt.status, got, tt.retryable)
+		}
+		if got := IsRejected(err); got != tt.rejected {
+			t.Errorf("status %d: IsRejected = %v, want %v", tt.status, got, tt.rejected)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package sender
+
+import (
+	"context"
+
+	"github.com/pingxeno/agent/protocol"
+)
+
+// Sink is a destination that payloads are delivered to. RetrySender adds
+// retries and a circuit breaker on top of any sink, and errors are
+// classified with IsRetryable and IsRejected.
+type Sink interface {
+	// SendMetrics delivers a single payload
+	SendMetrics(ctx context.Context, payload *protocol.MetricsPayload) error
+
+	// SendBatch delivers several payloads at once. It returns one error per
+	// payload (nil if it was accepted), or a request-level error if the
+	// batch as a whole could not be delivered.
+	SendBatch(ctx context.Context, payloads []*protocol.MetricsPayload) ([]error, error)
+
+	// Close releases the sink's resources
+	Close() error
+}
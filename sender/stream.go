@@ -0,0 +1,364 @@
+package sender
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/protocol"
+	"github.com/pingxeno/agent/signing"
+	"go.uber.org/zap"
+)
+
+// maxStreamMessage bounds the frames accepted from the API
+const maxStreamMessage = 1024 * 1024
+
+// Stream pushes payloads to the API over a long-lived WebSocket, avoiding a
+// new request and TLS handshake per collection. Payloads are kept until the
+// API acknowledges them and are resent after a reconnect; when the buffer is
+// full the oldest are dropped, so a slow connection never blocks collection.
+type Stream struct {
+	config  *config.Config
+	url     string
+	dialer  *websocket.Dialer
+	tls     *tlsSource
+	signer  *signing.Signer
+	agentID string
+	session string
+	policy  RetryPolicy
+	logger  *zap.Logger
+
+	mu        sync.Mutex
+	pending   []protocol.StreamMessage // Unacknowledged, oldest first
+	nextSeq   uint64
+	acked     uint64
+	dropping  bool
+	viewers   int
+	onViewers func(int)
+	wake      chan struct{}
+}
+
+// NewStream creates a stream to the configured stream URL. Nothing is
+// connected until Run is called.
+func NewStream(cfg *config.Config, agentID string, logger *zap.Logger) (*Stream, error) {
+	streamURL, err := streamURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsSource, err := newTLSSource(cfg.Security, logger)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	tlsConfig, _ := tlsSource.current()
+
+	proxy, err := newProxyRouter(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy settings: %w", err)
+	}
+
+	session := make([]byte, 16)
+	if _, err := rand.Read(session); err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %w", err)
+	}
+
+	var signer *signing.Signer
+	if cfg.Security.SigningSecret != "" {
+		signer = signing.NewSigner([]byte(cfg.Security.SigningSecret))
+	}
+
+	return &Stream{
+		config: cfg,
+		url:    streamURL,
+		dialer: &websocket.Dialer{
+			Proxy:             proxy.proxy,
+			TLSClientConfig:   tlsConfig,
+			HandshakeTimeout:  cfg.Security.Timeout,
+			EnableCompression: true,
+		},
+		tls:     tlsSource,
+		signer:  signer,
+		agentID: agentID,
+		session: hex.EncodeToString(session),
+		policy: RetryPolicy{
+			Backoff:    cfg.Sender.RetryBackoff,
+			MaxBackoff: cfg.Sender.RetryMaxBackoff,
+		},
+		logger: logger.With(zap.String("stream", streamURL)),
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// streamURL returns stream.url, or api_url with a WebSocket scheme and
+// /stream appended
+func streamURL(cfg *config.Config) (string, error) {
+	if cfg.Stream.URL != "" {
+		return cfg.Stream.URL, nil
+	}
+
+	u, err := url.Parse(cfg.Server.APIURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid api_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("cannot derive stream URL from api_url scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/stream"
+	return u.String(), nil
+}
+
+// OnViewers registers a function called with the number of attached
+// viewers whenever it changes. It is called with zero when the connection
+// is lost. It must be set before Run.
+func (s *Stream) OnViewers(fn func(viewers int)) {
+	s.onViewers = fn
+}
+
+// Publish queues a payload for streaming without blocking
+func (s *Stream) Publish(payload *protocol.MetricsPayload) {
+	s.mu.Lock()
+	s.nextSeq++
+	s.pending = append(s.pending, protocol.StreamMessage{
+		Type:    protocol.StreamMetrics,
+		Seq:     s.nextSeq,
+		Payload: payload,
+	})
+	if over := len(s.pending) - s.config.Stream.Buffer; over > 0 {
+		s.pending = append(s.pending[:0], s.pending[over:]...)
+		if !s.dropping {
+			s.dropping = true
+			s.logger.Warn("Stream buffer full, dropping oldest metrics",
+				zap.Int("buffer", s.config.Stream.Buffer),
+			)
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the stream connected until ctx is cancelled, reconnecting with
+// backoff after a failure
+func (s *Stream) Run(ctx context.Context) {
+	attempt := 0
+	for ctx.Err() == nil {
+		connected, err := s.connect(ctx)
+		s.setViewers(0)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that was established starts the backoff over
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		wait := s.policy.delay(attempt)
+
+		s.logger.Warn("Stream disconnected, reconnecting",
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+		if sleep(ctx, wait) != nil {
+			return
+		}
+	}
+}
+
+// connect runs one connection until it fails or ctx is cancelled. It
+// reports whether the handshake completed.
+func (s *Stream) connect(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	header.Set("X-API-Key", s.config.Server.APIKey)
+	if s.signer != nil {
+		req, err := http.NewRequest("GET", s.url, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header = header
+		if err := s.signer.Sign(req, nil); err != nil {
+			return false, err
+		}
+	}
+
+	if tlsConfig, changed := s.tls.current(); changed {
+		s.dialer.TLSClientConfig = tlsConfig
+	}
+	conn, resp, err := s.dialer.DialContext(ctx, s.url, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return false, &APIError{
+				StatusCode: resp.StatusCode,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+		}
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxStreamMessage)
+
+	sent, err := s.handshake(conn)
+	if err != nil {
+		return false, err
+	}
+
+	// The API answers pings automatically; any frame or pong keeps the
+	// connection alive for two more heartbeats
+	timeout := 2 * s.config.Stream.Heartbeat
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.read(conn, timeout)
+	}()
+
+	ping := time.NewTicker(s.config.Stream.Heartbeat)
+	defer ping.Stop()
+
+	for {
+		for _, msg := range s.unsent(sent) {
+			conn.SetWriteDeadline(time.Now().Add(s.config.Security.Timeout))
+			if err := conn.WriteJSON(&msg); err != nil {
+				return true, fmt.Errorf("failed to write: %w", err)
+			}
+			sent = msg.Seq
+		}
+
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "agent stopping"),
+				time.Now().Add(time.Second))
+			return true, ctx.Err()
+		case err := <-readErr:
+			return true, err
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.config.Security.Timeout)); err != nil {
+				return true, fmt.Errorf("failed to ping: %w", err)
+			}
+		case <-s.wake:
+		}
+	}
+}
+
+// handshake opens or resumes the session and returns the sequence number
+// after which messages must be (re)sent
+func (s *Stream) handshake(conn *websocket.Conn) (uint64, error) {
+	s.mu.Lock()
+	hello := protocol.StreamMessage{
+		Type:      protocol.StreamHello,
+		Session:   s.session,
+		Seq:       s.acked,
+		AgentID:   s.agentID,
+		ServerKey: s.config.Server.ServerKey,
+	}
+	s.mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(s.config.Security.Timeout))
+	if err := conn.WriteJSON(&hello); err != nil {
+		return 0, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	var welcome protocol.StreamMessage
+	conn.SetReadDeadline(time.Now().Add(s.config.Security.Timeout))
+	if err := conn.ReadJSON(&welcome); err != nil {
+		return 0, fmt.Errorf("failed to read welcome: %w", err)
+	}
+	if welcome.Type != protocol.StreamWelcome {
+		return 0, fmt.Errorf("expected welcome, got %q", welcome.Type)
+	}
+
+	s.ack(welcome.Seq)
+
+	s.mu.Lock()
+	resending := len(s.pending)
+	s.mu.Unlock()
+
+	s.logger.Info("Stream connected",
+		zap.Uint64("resume_from", welcome.Seq),
+		zap.Int("pending", resending),
+	)
+	return welcome.Seq, nil
+}
+
+// read handles acknowledgements and viewer updates until the connection fails
+func (s *Stream) read(conn *websocket.Conn, timeout time.Duration) error {
+	for {
+		var msg protocol.StreamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		switch msg.Type {
+		case protocol.StreamAck:
+			s.ack(msg.Seq)
+		case protocol.StreamViewers:
+			s.setViewers(msg.Viewers)
+		default:
+			s.logger.Debug("Ignoring unknown stream message", zap.String("type", msg.Type))
+		}
+	}
+}
+
+// unsent returns the pending messages after seq
+func (s *Stream) unsent(seq uint64) []protocol.StreamMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, msg := range s.pending {
+		if msg.Seq > seq {
+			return append([]protocol.StreamMessage(nil), s.pending[i:]...)
+		}
+	}
+	return nil
+}
+
+// ack drops the pending messages up to and including seq
+func (s *Stream) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.acked {
+		return
+	}
+	s.acked = seq
+	s.dropping = false
+
+	i := 0
+	for i < len(s.pending) && s.pending[i].Seq <= seq {
+		i++
+	}
+	s.pending = append(s.pending[:0], s.pending[i:]...)
+}
+
+// setViewers records the number of attached viewers and reports changes
+func (s *Stream) setViewers(n int) {
+	s.mu.Lock()
+	changed := n != s.viewers
+	s.viewers = n
+	s.mu.Unlock()
+
+	if changed && s.onViewers != nil {
+		s.onViewers(n)
+	}
+}
@@ -0,0 +1,259 @@
+package sender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"go.uber.org/zap"
+)
+
+// tlsVersions maps security.min_tls_version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsSource provides the client TLS configuration. The CA bundle and client
+// certificate are read from disk again whenever their files have changed, so
+// rotated certificates are picked up without a restart.
+//
+// Server certificates are checked by the standard verification against
+// security.server_name, or the dialed host when that is empty, which covers
+// IP addresses as well. security.ca_file is trusted in addition to the
+// system roots. Since a configuration's root pool cannot change once
+// connections use it, a reloaded CA bundle yields a new configuration.
+type tlsSource struct {
+	store *certStore
+	base  *tls.Config
+
+	mu     sync.Mutex
+	pool   *x509.CertPool
+	config *tls.Config
+}
+
+// newTLSSource validates the security settings and loads the certificates
+func newTLSSource(sec config.SecurityConfig, logger *zap.Logger) (*tlsSource, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: sec.TLSSkipVerify,
+		ServerName:         sec.ServerName,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if sec.MinTLSVersion != "" {
+		version, ok := tlsVersions[sec.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %q", sec.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if (sec.ClientCertFile == "") != (sec.ClientKeyFile == "") {
+		return nil, errors.New("client_cert_file and client_key_file must be set together")
+	}
+
+	store := &certStore{
+		caFile:   sec.CAFile,
+		certFile: sec.ClientCertFile,
+		keyFile:  sec.ClientKeyFile,
+		logger:   logger,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	if store.certFile != "" {
+		tlsConfig.GetClientCertificate = store.clientCertificate
+	}
+
+	s := &tlsSource{store: store, base: tlsConfig}
+	s.current()
+	return s, nil
+}
+
+// current returns the configuration for new connections, and whether it
+// replaced the one returned before because the CA bundle was reloaded
+func (s *tlsSource) current() (*tls.Config, bool) {
+	s.store.refresh()
+
+	s.store.mu.Lock()
+	pool := s.store.pool
+	s.store.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config != nil && pool == s.pool {
+		return s.config, false
+	}
+	config := s.base.Clone()
+	config.RootCAs = pool
+	s.pool, s.config = pool, config
+	return config, true
+}
+
+// transport is an http.RoundTripper that replaces its underlying transport
+// when the TLS configuration changes, closing the idle connections made
+// with the previous one
+type transport struct {
+	tls   *tlsSource
+	proxy func(*http.Request) (*url.URL, error)
+
+	mu sync.Mutex
+	tr *http.Transport
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	config, changed := t.tls.current()
+
+	t.mu.Lock()
+	if changed || t.tr == nil {
+		if t.tr != nil {
+			t.tr.CloseIdleConnections()
+		}
+		t.tr = &http.Transport{
+			Proxy:           t.proxy,
+			TLSClientConfig: config,
+		}
+	}
+	tr := t.tr
+	t.mu.Unlock()
+
+	return tr.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the current transport
+func (t *transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tr != nil {
+		t.tr.CloseIdleConnections()
+	}
+}
+
+// certStore holds the CA pool and client certificate loaded from disk
+type certStore struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	caMod   time.Time
+	certMod time.Time
+	keyMod  time.Time
+	pool    *x509.CertPool
+	cert    *tls.Certificate
+}
+
+// load reads all configured files, failing if any of them is invalid
+func (s *certStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.caFile != "" {
+		if err := s.loadCA(); err != nil {
+			return err
+		}
+	}
+	if s.certFile != "" {
+		if err := s.loadCert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh reloads files that changed since they were last read. On error the
+// previously loaded material is kept, so a half-written rotation does not
+// break sending.
+func (s *certStore) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.caFile != "" && changed(s.caFile, s.caMod) {
+		if err := s.loadCA(); err != nil {
+			s.logger.Warn("Failed to reload CA bundle, keeping previous one", zap.Error(err))
+		} else {
+			s.logger.Info("Reloaded CA bundle", zap.String("file", s.caFile))
+		}
+	}
+	if s.certFile != "" && (changed(s.certFile, s.certMod) || changed(s.keyFile, s.keyMod)) {
+		if err := s.loadCert(); err != nil {
+			s.logger.Warn("Failed to reload client certificate, keeping previous one", zap.Error(err))
+		} else {
+			s.logger.Info("Reloaded client certificate", zap.String("file", s.certFile))
+		}
+	}
+}
+
+func (s *certStore) loadCA() error {
+	info, err := os.Stat(s.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %w", err)
+	}
+	data, err := os.ReadFile(s.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	// The bundle adds to the system roots, as the same settings are used
+	// for publicly-signed hosts such as metrics backends and release hosts
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in CA file %s", s.caFile)
+	}
+
+	s.pool = pool
+	s.caMod = info.ModTime()
+	return nil
+}
+
+func (s *certStore) loadCert() error {
+	certInfo, err := os.Stat(s.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(s.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client key: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	s.cert = &cert
+	s.certMod = certInfo.ModTime()
+	s.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// clientCertificate implements tls.Config.GetClientCertificate
+func (s *certStore) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.refresh()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cert, nil
+}
+
+// changed reports whether a file's modification time differs from mod
+func changed(path string, mod time.Time) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.ModTime().Equal(mod)
+}
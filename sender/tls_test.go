@@ -0,0 +1,229 @@
+package sender
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"go.uber.org/zap"
+)
+
+// testCA issues server certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a server certificate for the given names and addresses
+func (ca *testCA) issue(t *testing.T, dnsNames []string, ips []net.IP) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// get requests the root of a TLS server presenting cert, with the CA bundle
+// written to a file as security.ca_file
+func get(t *testing.T, ca *testCA, cert tls.Certificate, serverName string) error {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Security.CAFile = caFile
+	cfg.Security.ServerName = serverName
+	cfg.Security.Timeout = 5 * time.Second
+
+	client, _, err := newHTTPClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+
+	// srv.URL is https://127.0.0.1:port, so no SNI is sent
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestCAFileVerifiesIPAddress(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, nil, []net.IP{net.ParseIP("127.0.0.1")})
+
+	if err := get(t, ca, cert, ""); err != nil {
+		t.Fatalf("certificate with a matching IP SAN was refused: %v", err)
+	}
+}
+
+func TestCAFileRejectsMismatchedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, []string{"other.example"}, nil)
+
+	err := get(t, ca, cert, "")
+	if err == nil {
+		t.Fatal("certificate for another host was accepted")
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1") {
+		t.Fatalf("expected a hostname mismatch, got: %v", err)
+	}
+}
+
+func TestCAFileHonoursServerName(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, []string{"api.internal"}, nil)
+
+	if err := get(t, ca, cert, "api.internal"); err != nil {
+		t.Fatalf("certificate matching security.server_name was refused: %v", err)
+	}
+	if err := get(t, ca, cert, "other.internal"); err == nil {
+		t.Fatal("certificate not matching security.server_name was accepted")
+	}
+}
+
+func TestCAFileRejectsUnknownCA(t *testing.T) {
+	trusted := newTestCA(t)
+	other := newTestCA(t)
+	cert := other.issue(t, nil, []net.IP{net.ParseIP("127.0.0.1")})
+
+	if err := get(t, trusted, cert, ""); err == nil {
+		t.Fatal("certificate from an untrusted CA was accepted")
+	}
+}
+
+func TestExternalPosterOmitsAPISettings(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, nil, []net.IP{net.ParseIP("127.0.0.1")})
+
+	var presented int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = len(r.TLS.PeerCertificates)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequestClientCert}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// A client certificate and server name meant for the API
+	dir := t.TempDir()
+	clientCert := ca.issue(t, []string{"agent"}, nil)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"ca.pem":     ca.pem,
+		"client.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}),
+		"client.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Security.CAFile = filepath.Join(dir, "ca.pem")
+	cfg.Security.ClientCertFile = filepath.Join(dir, "client.pem")
+	cfg.Security.ClientKeyFile = filepath.Join(dir, "client.key")
+	cfg.Security.ServerName = "api.internal"
+	cfg.Security.Timeout = 5 * time.Second
+
+	api, err := NewPoster(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	if _, err := api.Get(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("API poster accepted a certificate not matching security.server_name")
+	}
+
+	external, err := NewExternalPoster(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer external.Close()
+	if _, err := external.Get(context.Background(), srv.URL, nil); err != nil {
+		t.Fatalf("external poster: %v", err)
+	}
+	if presented != 0 {
+		t.Errorf("external poster presented %d client certificates, want none", presented)
+	}
+}
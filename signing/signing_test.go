@@ -0,0 +1,135 @@
+package signing
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("shared secret")
+	body := []byte(`{"hostname":"web-1"}`)
+
+	tests := []struct {
+		name string
+		// sign, if set, replaces the default signer
+		signer *Signer
+		// tamper changes the signed request before it is verified; the
+		// returned body is the one the verifier sees
+		tamper func(req *http.Request) []byte
+		want   error
+	}{
+		{name: "valid"},
+		{
+			name:   "tampered body",
+			tamper: func(req *http.Request) []byte { return []byte(`{"hostname":"web-2"}`) },
+			want:   ErrBodyMismatch,
+		},
+		{
+			name: "tampered body with its hash",
+			tamper: func(req *http.Request) []byte {
+				forged := []byte(`{"hostname":"web-2"}`)
+				req.Header.Set(HeaderContentSHA256, hashBody(forged))
+				return forged
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "tampered path",
+			tamper: func(req *http.Request) []byte {
+				req.URL.Path = "/api/v1/admin"
+				return body
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name:   "stale timestamp",
+			signer: &Signer{secret: secret, now: func() time.Time { return time.Now().Add(-10 * time.Minute) }},
+			want:   ErrStaleTimestamp,
+		},
+		{
+			name:   "future timestamp",
+			signer: &Signer{secret: secret, now: func() time.Time { return time.Now().Add(10 * time.Minute) }},
+			want:   ErrStaleTimestamp,
+		},
+		{
+			name:   "wrong secret",
+			signer: NewSigner([]byte("other secret")),
+			want:   ErrBadSignature,
+		},
+		{
+			name: "missing signature",
+			tamper: func(req *http.Request) []byte {
+				req.Header.Del(HeaderSignature)
+				return body
+			},
+			want: ErrMissingSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := tt.signer
+			if signer == nil {
+				signer = NewSigner(secret)
+			}
+			req := newRequest(t, body)
+			if err := signer.Sign(req, body); err != nil {
+				t.Fatal(err)
+			}
+
+			received := body
+			if tt.tamper != nil {
+				received = tt.tamper(req)
+			}
+
+			err := NewVerifier(secret, 5*time.Minute).Verify(req, received)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplayedNonce(t *testing.T) {
+	secret := []byte("shared secret")
+	body := []byte(`{"hostname":"web-1"}`)
+	verifier := NewVerifier(secret, 5*time.Minute)
+
+	req := newRequest(t, body)
+	if err := NewSigner(secret).Sign(req, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(req, body); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := verifier.Verify(req, body); !errors.Is(err, ErrReplayedNonce) {
+		t.Errorf("replayed request: %v, want %v", err, ErrReplayedNonce)
+	}
+}
+
+func TestQueryIsNotSigned(t *testing.T) {
+	secret := []byte("shared secret")
+	body := []byte(`{}`)
+
+	req := newRequest(t, body)
+	if err := NewSigner(secret).Sign(req, body); err != nil {
+		t.Fatal(err)
+	}
+	req.URL.RawQuery = "dry_run=false"
+
+	if err := NewVerifier(secret, 5*time.Minute).Verify(req, body); err != nil {
+		t.Errorf("Verify = %v; the query string is documented as unsigned", err)
+	}
+}
+
+func newRequest(t *testing.T, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", "https://api.example/api/v1/metrics", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
@@ -0,0 +1,127 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verification errors
+var (
+	ErrMissingSignature = errors.New("signing: missing signature headers")
+	ErrStaleTimestamp   = errors.New("signing: timestamp outside allowed skew")
+	ErrReplayedNonce    = errors.New("signing: nonce already used")
+	ErrBodyMismatch     = errors.New("signing: body does not match content hash")
+	ErrBadSignature     = errors.New("signing: signature mismatch")
+)
+
+// Verifier checks signatures produced by Signer and rejects stale or
+// replayed requests. Nonces are remembered for twice the allowed skew,
+// which covers every timestamp that could still be accepted.
+type Verifier struct {
+	secret  []byte
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewVerifier creates a verifier that accepts timestamps within maxSkew
+// of the local clock
+func NewVerifier(secret []byte, maxSkew time.Duration) *Verifier {
+	return &Verifier{
+		secret:  secret,
+		maxSkew: maxSkew,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Verify checks the signature of req against body, the raw request body
+// as received (before any decompression)
+func (v *Verifier) Verify(req *http.Request, body []byte) error {
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	bodyHash := req.Header.Get(HeaderContentSHA256)
+	signature := req.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || bodyHash == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	now := v.now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > v.maxSkew || skew < -v.maxSkew {
+		return ErrStaleTimestamp
+	}
+
+	if !hmac.Equal([]byte(hashBody(body)), []byte(strings.ToLower(bodyHash))) {
+		return ErrBodyMismatch
+	}
+
+	version, mac, ok := strings.Cut(signature, "=")
+	if !ok || version != signatureVersion {
+		return ErrBadSignature
+	}
+	expected := sign(v.secret, req.Method, requestPath(req), timestamp, nonce, hashBody(body))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(mac))) {
+		return ErrBadSignature
+	}
+
+	// Only record nonces of authentic requests, so forged ones cannot
+	// fill the cache
+	return v.remember(nonce, now)
+}
+
+// Middleware verifies requests before passing them to next, responding
+// with 401 if verification fails. The body is restored for next to read.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		if err := v.Verify(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remember records a nonce, failing if it was already used
+func (v *Verifier) remember(nonce string, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastSweep) >= time.Second {
+		cutoff := now.Add(-2 * v.maxSkew)
+		for n, t := range v.seen {
+			if t.Before(cutoff) {
+				delete(v.seen, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if _, ok := v.seen[nonce]; ok {
+		return ErrReplayedNonce
+	}
+	v.seen[nonce] = now
+	return nil
+}
@@ -0,0 +1,470 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingxeno/agent/config"
+	"github.com/pingxeno/agent/sender"
+	"go.uber.org/zap"
+)
+
+// Manifest describes the latest release. Builds are keyed by platform in
+// GOOS/GOARCH form, e.g. "linux/amd64".
+type Manifest struct {
+	Version string           `json:"version"`
+	Builds  map[string]Build `json:"builds"`
+}
+
+// Build is the agent binary for one platform. Signature is a detached
+// Ed25519 signature over the binary, base64 encoded.
+type Build struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Release is the build of a newer version for the running platform
+type Release struct {
+	Version string
+	Build
+}
+
+// Updater replaces the running binary with newer signed releases. The
+// previous binary is kept next to it with an .old suffix; if the new one
+// fails its health check it is moved back, and the version is recorded in
+// the state directory so the background check does not retry it.
+type Updater struct {
+	config     config.UpdateConfig
+	configPath string
+	version    string
+	exe        string
+	publicKey  ed25519.PublicKey
+	poster     *sender.Poster
+	policy     sender.RetryPolicy
+	logger     *zap.Logger
+
+	failed     string // Version that last failed its health check
+	failedFile string // Where failed is persisted
+}
+
+// New creates an updater for the running executable. configPath is passed
+// to the new binary for its health check.
+func New(cfg *config.Config, configPath, version string, logger *zap.Logger) (*Updater, error) {
+	if cfg.Update.ManifestURL == "" {
+		return nil, errors.New("update.manifest_url is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.Update.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("update.public_key must be a base64 Ed25519 public key")
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	poster, err := sender.NewExternalPoster(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	u := &Updater{
+		config:     cfg.Update,
+		configPath: configPath,
+		version:    version,
+		exe:        exe,
+		publicKey:  ed25519.PublicKey(key),
+		poster:     poster,
+		policy: sender.RetryPolicy{
+			Backoff:    cfg.Sender.RetryBackoff,
+			MaxBackoff: cfg.Sender.RetryMaxBackoff,
+		},
+		logger:     logger.With(zap.String("component", "updater")),
+		failedFile: filepath.Join(config.DefaultStateDir(), "update-failed"),
+	}
+	if data, err := os.ReadFile(u.failedFile); err == nil {
+		u.failed = strings.TrimSpace(string(data))
+	}
+	return u, nil
+}
+
+// Path returns the executable the updater replaces
+func (u *Updater) Path() string {
+	return u.exe
+}
+
+// Close releases the updater's connections
+func (u *Updater) Close() error {
+	return u.poster.Close()
+}
+
+// Check fetches the manifest and returns the release for this platform if
+// it is newer than the running version, or nil otherwise
+func (u *Updater) Check(ctx context.Context) (*Release, error) {
+	body, err := u.poster.Get(ctx, u.config.ManifestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if !newer(manifest.Version, u.version) {
+		return nil, nil
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	build, ok := manifest.Builds[platform]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no build for %s", manifest.Version, platform)
+	}
+	return &Release{Version: manifest.Version, Build: build}, nil
+}
+
+// Apply downloads and verifies a release, swaps it in and health-checks
+// it. If the check fails the previous binary is restored and the error
+// returned; on success the new binary takes effect when the agent restarts.
+func (u *Updater) Apply(ctx context.Context, release *Release) error {
+	path, err := u.download(ctx, release)
+	if err != nil {
+		return err
+	}
+	return u.install(ctx, release, path)
+}
+
+// download streams a release's binary to a temporary file next to the
+// executable, so it can be renamed into place, and returns its path. The
+// download is limited by download_timeout rather than security.timeout.
+func (u *Updater) download(ctx context.Context, release *Release) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.config.DownloadTimeout)
+	defer cancel()
+
+	f, err := os.CreateTemp(filepath.Dir(u.exe), filepath.Base(u.exe)+".download-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create download file: %w", err)
+	}
+	_, err = u.poster.Download(ctx, release.URL, nil, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to download %s: %w", release.URL, err)
+	}
+	return f.Name(), nil
+}
+
+// install verifies a downloaded binary, swaps it in and health-checks it.
+// A version that fails the check is recorded so Run skips it. The
+// downloaded file is removed unless it was moved into place.
+func (u *Updater) install(ctx context.Context, release *Release, path string) error {
+	defer os.Remove(path)
+
+	if err := u.verify(path, release.Build); err != nil {
+		return fmt.Errorf("release %s failed verification: %w", release.Version, err)
+	}
+
+	if err := u.swap(path); err != nil {
+		return fmt.Errorf("failed to install release %s: %w", release.Version, err)
+	}
+	u.logger.Info("Installed new binary, checking health",
+		zap.String("version", release.Version),
+		zap.String("path", u.exe),
+	)
+
+	if err := u.healthCheck(ctx, release.Version); err != nil {
+		u.markFailed(release.Version)
+		if rbErr := u.rollback(); rbErr != nil {
+			return fmt.Errorf("release %s failed health check (%v) and rollback failed: %w", release.Version, err, rbErr)
+		}
+		u.logger.Warn("New binary failed health check, rolled back",
+			zap.String("version", release.Version),
+			zap.Error(err),
+		)
+		return fmt.Errorf("release %s failed health check, rolled back: %w", release.Version, err)
+	}
+	if u.failed == release.Version {
+		u.markFailed("")
+	}
+	return nil
+}
+
+// markFailed records the version that failed its health check, or clears
+// the record if version is empty
+func (u *Updater) markFailed(version string) {
+	u.failed = version
+
+	var err error
+	if version == "" {
+		err = os.Remove(u.failedFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else if err = os.MkdirAll(filepath.Dir(u.failedFile), 0700); err == nil {
+		err = os.WriteFile(u.failedFile, []byte(version+"\n"), 0600)
+	}
+	if err != nil {
+		u.logger.Warn("Failed to record failed release", zap.Error(err))
+	}
+}
+
+// Run checks for updates every check_interval until one is applied or ctx
+// is cancelled. onUpdate is called with the new version, after which the
+// process should be restarted to run it. A version that failed its health
+// check is skipped until the manifest advertises a different one; only
+// manifest and download errors are retried sooner than check_interval.
+func (u *Updater) Run(ctx context.Context, onUpdate func(version string)) {
+	defer u.Close()
+
+	failures := 0
+	for {
+		wait := u.config.CheckInterval
+		// fetchErr is a manifest or download error, retried with backoff;
+		// err is any other failure, retried at the next check
+		var err error
+		release, fetchErr := u.Check(ctx)
+		switch {
+		case fetchErr != nil || release == nil:
+		case release.Version == u.failed:
+			u.logger.Debug("Skipping release that failed its health check",
+				zap.String("version", release.Version),
+			)
+		default:
+			u.logger.Info("Update available",
+				zap.String("version", release.Version),
+				zap.String("current", u.version),
+			)
+			var path string
+			if path, fetchErr = u.download(ctx, release); fetchErr == nil {
+				if err = u.install(ctx, release, path); err == nil {
+					onUpdate(release.Version)
+					return
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if fetchErr != nil {
+			failures++
+			if backoff := u.policy.Delay(failures); backoff < wait {
+				wait = backoff
+			}
+			err = fetchErr
+		} else {
+			failures = 0
+		}
+		if err != nil {
+			u.logger.Warn("Update failed",
+				zap.Duration("retry_in", wait),
+				zap.Error(err),
+			)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// verify checks the downloaded binary against the manifest's digest and
+// signature. The digest is checked first while streaming the file; an
+// Ed25519 signature covers the whole binary, so it is only read into
+// memory once the digest matches.
+func (u *Updater) verify(path string, build Build) error {
+	want, err := hex.DecodeString(build.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("manifest has an invalid sha256")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, want) {
+		return fmt.Errorf("sha256 mismatch: got %x", sum)
+	}
+
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(build.Signature)
+	if err != nil || !ed25519.Verify(u.publicKey, binary, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// swap moves the downloaded binary, which is next to the running one,
+// into place, keeping the running one as the backup
+func (u *Updater) swap(next string) error {
+	backup := u.exe + ".old"
+
+	if err := os.Chmod(next, 0755); err != nil {
+		return err
+	}
+	os.Remove(backup)
+
+	// A running executable cannot be replaced on Windows, only renamed, so
+	// there the binary is briefly missing
+	if runtime.GOOS == "windows" {
+		if err := os.Rename(u.exe, backup); err != nil {
+			return err
+		}
+		if err := os.Rename(next, u.exe); err != nil {
+			os.Rename(backup, u.exe)
+			return err
+		}
+		return nil
+	}
+
+	if err := os.Link(u.exe, backup); err != nil {
+		if err := copyFile(u.exe, backup); err != nil {
+			return fmt.Errorf("failed to back up current binary: %w", err)
+		}
+	}
+	return os.Rename(next, u.exe)
+}
+
+// rollback moves the backup back into place
+func (u *Updater) rollback() error {
+	backup := u.exe + ".old"
+	if runtime.GOOS == "windows" {
+		if err := os.Remove(u.exe); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(backup, u.exe)
+}
+
+// healthCheck runs the installed binary: it must report the expected
+// version, then collect and send one payload with the agent's config
+func (u *Updater) healthCheck(ctx context.Context, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, u.config.HealthTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, u.exe, "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start: %w: %s", err, tail(out))
+	}
+	if got := reportedVersion(out); got != strings.TrimPrefix(version, "v") {
+		return fmt.Errorf("reports version %q, expected %s", strings.TrimSpace(string(out)), version)
+	}
+
+	args := []string{"test"}
+	if u.configPath != "" {
+		args = append(args, "--config", u.configPath)
+	}
+	out, err = exec.CommandContext(ctx, u.exe, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to send: %w: %s", err, tail(out))
+	}
+	return nil
+}
+
+// reportedVersion returns the version printed by the version command, e.g.
+// "1.2.3" for "PingXeno Agent v1.2.3", without the leading v
+func reportedVersion(out []byte) string {
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(fields[len(fields)-1], "v")
+}
+
+// newer reports whether version a is newer than b. Versions are compared
+// by their dot-separated numeric parts; a leading v and any suffix after
+// the numbers, such as -rc1, are ignored.
+func newer(a, b string) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	var parts []int
+	for _, s := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// copyFile copies src to dst with the same permissions
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// tail returns the last line of a command's output for error messages
+func tail(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}